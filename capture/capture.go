@@ -0,0 +1,221 @@
+// Package capture records MQTT traffic to files and replays it, so that
+// sessions with real devices can be reproduced later, e.g. in tests.
+//
+// A capture is a JSON lines file with one Record per line.
+package capture
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Record is a single captured message.
+type Record struct {
+	Time     time.Time
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+}
+
+// jsonRecord is the file format of a Record. Payloads are stored as text
+// when they are valid UTF-8, which they almost always are for Shelly
+// devices, and base64 encoded otherwise.
+type jsonRecord struct {
+	Time          time.Time `json:"time"`
+	Topic         string    `json:"topic"`
+	Payload       *string   `json:"payload,omitempty"`
+	PayloadBase64 string    `json:"payload_base64,omitempty"`
+	QoS           byte      `json:"qos"`
+	Retained      bool      `json:"retained"`
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	out := jsonRecord{Time: r.Time, Topic: r.Topic, QoS: r.QoS, Retained: r.Retained}
+	if utf8.Valid(r.Payload) {
+		payload := string(r.Payload)
+		out.Payload = &payload
+	} else {
+		out.PayloadBase64 = base64.StdEncoding.EncodeToString(r.Payload)
+	}
+	return json.Marshal(out)
+}
+
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var in jsonRecord
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*r = Record{Time: in.Time, Topic: in.Topic, QoS: in.QoS, Retained: in.Retained}
+	if in.Payload != nil {
+		r.Payload = []byte(*in.Payload)
+		return nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(in.PayloadBase64)
+	if err != nil {
+		return err
+	}
+	r.Payload = payload
+	return nil
+}
+
+// FromMessage returns a record of message received at t.
+func FromMessage(message MQTT.Message, t time.Time) Record {
+	return Record{
+		Time:     t,
+		Topic:    message.Topic(),
+		Payload:  append([]byte{}, message.Payload()...),
+		QoS:      message.Qos(),
+		Retained: message.Retained(),
+	}
+}
+
+// Writer appends records to a capture. It is safe for concurrent use.
+type Writer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+func (w *Writer) Write(record Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(record)
+}
+
+// Handler returns a message handler that records every message it receives
+// with the time of arrival. Write errors are passed to onError, which may be
+// nil.
+func (w *Writer) Handler(onError func(error)) MQTT.MessageHandler {
+	return func(client MQTT.Client, message MQTT.Message) {
+		if err := w.Write(FromMessage(message, time.Now())); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Reader reads records from a capture.
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// maxRecordSize bounds the size of a single line of a capture.
+const maxRecordSize = 1 << 20
+
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next record, or io.EOF at the end of the capture. Empty
+// lines are skipped.
+func (r *Reader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			return Record{}, &SyntaxError{Line: r.line, Err: err}
+		}
+		return record, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+// ReadAll reads every record of a capture.
+func ReadAll(r io.Reader) ([]Record, error) {
+	reader := NewReader(r)
+	var records []Record
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// SyntaxError reports a malformed line of a capture.
+type SyntaxError struct {
+	Line int
+	Err  error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("capture: line %d: %v", e.Line, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// Replay passes records to publish, keeping the time between them divided
+// by speed. A speed of 0 or less replays without any delay. Replay stops at
+// the first error of publish or when ctx is done.
+func Replay(
+	ctx context.Context,
+	records []Record,
+	speed float64,
+	publish func(Record) error,
+) error {
+	start := time.Now()
+	for i, record := range records {
+		if speed > 0 && i > 0 {
+			offset := time.Duration(float64(record.Time.Sub(records[0].Time)) / speed)
+			timer := time.NewTimer(time.Until(start.Add(offset)))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := publish(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Publisher returns a publish function for Replay that republishes records
+// on mqttClient with their original QoS and retain flag. Waiting for the
+// broker to acknowledge a record ends when ctx is done.
+func Publisher(ctx context.Context, mqttClient MQTT.Client) func(Record) error {
+	return func(record Record) error {
+		token := mqttClient.Publish(record.Topic, record.QoS, record.Retained, record.Payload)
+		select {
+		case <-token.Done():
+			return token.Error()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
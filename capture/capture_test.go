@@ -0,0 +1,123 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestRoundTrip(t *testing.T) {
+	start := time.Date(2023, 1, 13, 17, 42, 0, 0, time.UTC)
+	records := []Record{
+		{Time: start, Topic: "shellies/x/online", Payload: []byte("true"), Retained: true},
+		{Time: start.Add(time.Second), Topic: "shellies/x/relay/0", Payload: []byte("on"), QoS: 1},
+		{Time: start.Add(2 * time.Second), Topic: "shellies/x/raw", Payload: []byte{0xff, 0x00}},
+		{Time: start.Add(3 * time.Second), Topic: "shellies/x/command", Payload: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(buf.String(), `"payload":"on"`) {
+		t.Errorf("text payloads should stay readable: %s", buf.String())
+	}
+
+	got, err := ReadAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %d records, want %d", len(got), len(records))
+	}
+	for i := range records {
+		want := records[i]
+		if !got[i].Time.Equal(want.Time) || got[i].Topic != want.Topic ||
+			!bytes.Equal(got[i].Payload, want.Payload) || got[i].QoS != want.QoS ||
+			got[i].Retained != want.Retained {
+			t.Errorf("record %d: got %+v, want %+v", i, got[i], want)
+		}
+	}
+}
+
+func TestReadSyntaxError(t *testing.T) {
+	_, err := ReadAll(strings.NewReader("{\"topic\":\"a\"}\n\nnot json\n"))
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Line != 3 {
+		t.Errorf("got %v, want a syntax error on line 3", err)
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	start := time.Now()
+	records := []Record{
+		{Time: start, Topic: "a"},
+		{Time: start.Add(time.Second), Topic: "b"},
+		{Time: start.Add(2 * time.Second), Topic: "c"},
+	}
+
+	var topics []string
+	began := time.Now()
+	err := Replay(context.Background(), records, 100, func(r Record) error {
+		topics = append(topics, r.Topic)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(began); elapsed < 20*time.Millisecond {
+		t.Errorf("replay at 100x took %v, want at least 20ms", elapsed)
+	}
+	if strings.Join(topics, ",") != "a,b,c" {
+		t.Errorf("got topics %v", topics)
+	}
+}
+
+func TestReplayCancel(t *testing.T) {
+	start := time.Now()
+	records := []Record{{Time: start}, {Time: start.Add(time.Hour)}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	calls := 0
+	err := Replay(ctx, records, 1, func(Record) error {
+		calls++
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || calls != 1 {
+		t.Errorf("got %v after %d records, want deadline exceeded after 1", err, calls)
+	}
+}
+
+// stuckClient never completes a publish.
+type stuckClient struct {
+	MQTT.Client
+}
+
+func (stuckClient) Publish(string, byte, bool, interface{}) MQTT.Token {
+	return stuckToken{}
+}
+
+type stuckToken struct{}
+
+func (stuckToken) Wait() bool                     { select {} }
+func (stuckToken) WaitTimeout(time.Duration) bool { return false }
+func (stuckToken) Done() <-chan struct{}          { return nil }
+func (stuckToken) Error() error                   { return nil }
+
+func TestPublisherCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := Publisher(ctx, stuckClient{})(Record{Topic: "a"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+}
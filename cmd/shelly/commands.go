@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	shelly "github.com/washed/shelly-go"
+)
+
+// newFlagSet returns a flag set for a command that reports errors through
+// errUsage.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	return nil
+}
+
+// deviceId strips the device type from arg, so that commands accept both
+// "EF6948" and "shellyplug-s-EF6948".
+func deviceId(arg string, deviceType string) string {
+	return strings.TrimPrefix(arg, deviceType+"-")
+}
+
+type discoveredDevice struct {
+	ID       string    `json:"id"`
+	Model    string    `json:"model"`
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	FWVer    string    `json:"fw_ver"`
+	NewFW    bool      `json:"new_fw"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// discover asks all devices to announce themselves and collects the answers
+// that arrive within wait.
+func (a *app) discover(ctx context.Context, wait time.Duration) ([]discoveredDevice, error) {
+	conn, err := a.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	registry := a.registry(conn)
+	discoverCtx, cancel := context.WithTimeout(ctx, a.flags.timeout)
+	defer cancel()
+	if err := registry.DiscoverCtx(discoverCtx); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	devices := []discoveredDevice{}
+	for _, d := range registry.Devices() {
+		devices = append(devices, discoveredDevice{
+			ID:       d.ID,
+			Model:    d.Model,
+			MAC:      d.MAC,
+			IP:       d.IP,
+			FWVer:    d.FWVer,
+			NewFW:    d.NewFW,
+			LastSeen: d.LastSeen,
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, nil
+}
+
+func runDiscover(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("discover")
+	wait := fs.Duration("wait", 2*time.Second, "how long to wait for announcements")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	devices, err := a.discover(ctx, *wait)
+	if err != nil {
+		return err
+	}
+	return a.print(devices, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tMODEL\tIP\tMAC\tFIRMWARE")
+		for _, d := range devices {
+			fw := d.FWVer
+			if d.NewFW {
+				fw += " (update available)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.ID, d.Model, d.IP, d.MAC, fw)
+		}
+	})
+}
+
+type commandResult struct {
+	Device    string      `json:"device"`
+	Command   string      `json:"command"`
+	Value     interface{} `json:"value"`
+	Confirmed bool        `json:"confirmed"`
+}
+
+func (a *app) printResult(result commandResult) error {
+	text := fmt.Sprintf("%s: %s %v", result.Device, result.Command, result.Value)
+	if result.Confirmed {
+		text += " (confirmed)"
+	}
+	return a.printLine(result, text)
+}
+
+func runPlug(ctx context.Context, a *app, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	action := args[0]
+	fs := newFlagSet("plug")
+	noConfirm := fs.Bool("no-confirm", false, "do not wait for the plug to report the new state")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (action != "on" && action != "off") {
+		return errUsage
+	}
+
+	conn, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+	plugS := conn.NewShellyPlugS(deviceId(fs.Arg(0), "shellyplug-s"), a.deviceOptions()...)
+	ctx, cancel := context.WithTimeout(ctx, a.flags.timeout)
+	defer cancel()
+
+	switch {
+	case action == "on" && *noConfirm:
+		err = plugS.SwitchOnCtx(ctx)
+	case action == "on":
+		err = plugS.SwitchOnConfirmedCtx(ctx)
+	case *noConfirm:
+		err = plugS.SwitchOffCtx(ctx)
+	default:
+		err = plugS.SwitchOffConfirmedCtx(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return a.printResult(commandResult{
+		Device:    plugS.DeviceName(),
+		Command:   "relay",
+		Value:     action,
+		Confirmed: !*noConfirm,
+	})
+}
+
+func runTRV(ctx context.Context, a *app, args []string) error {
+	if len(args) == 0 || args[0] != "set-target" {
+		return errUsage
+	}
+	fs := newFlagSet("trv")
+	noConfirm := fs.Bool("no-confirm", false, "do not wait for the TRV to report the new target")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	target, err := strconv.ParseFloat(fs.Arg(1), 32)
+	if err != nil {
+		return fmt.Errorf("%w: invalid temperature %q", errUsage, fs.Arg(1))
+	}
+
+	conn, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+	trv := conn.NewShellyTRV(deviceId(fs.Arg(0), "shellytrv"), a.deviceOptions()...)
+	ctx, cancel := context.WithTimeout(ctx, a.flags.timeout)
+	defer cancel()
+
+	if *noConfirm {
+		err = trv.SetTargetTemperatureCtx(ctx, float32(target))
+	} else {
+		err = trv.SetTargetTemperatureConfirmedCtx(ctx, float32(target))
+	}
+	if err != nil {
+		return err
+	}
+	return a.printResult(commandResult{
+		Device:    trv.DeviceName(),
+		Command:   "target_t",
+		Value:     float32(target),
+		Confirmed: !*noConfirm,
+	})
+}
+
+// watchedMessage is a device message as watch and status print it.
+type watchedMessage struct {
+	Time     time.Time       `json:"time"`
+	Device   string          `json:"device"`
+	Subtopic string          `json:"subtopic"`
+	Payload  string          `json:"payload"`
+	Value    json.RawMessage `json:"value,omitempty"`
+}
+
+func newWatchedMessage(message MQTT.Message) (watchedMessage, shelly.TopicInfo) {
+	info, _ := shelly.ParseTopic(message.Topic())
+	watched := watchedMessage{
+		Time:     time.Now(),
+		Device:   info.DeviceName(),
+		Subtopic: info.Subtopic,
+		Payload:  string(message.Payload()),
+	}
+	if decoded, err := shelly.DecodeMessage(message.Topic(), message.Payload()); err == nil {
+		if value, err := json.Marshal(decoded.Value); err == nil {
+			watched.Value = value
+		}
+	}
+	return watched, info
+}
+
+// subscribe subscribes to filter with the subscription API of the library,
+// which renews it after a reconnect.
+func (a *app) subscribe(
+	ctx context.Context,
+	filter string,
+	handler MQTT.MessageHandler,
+) (*shelly.Subscription, error) {
+	conn, err := a.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	subscribeCtx, cancel := context.WithTimeout(ctx, a.flags.timeout)
+	defer cancel()
+	subscription, err := conn.SubscribeCtx(subscribeCtx, filter, handler)
+	if err != nil {
+		return nil, fmt.Errorf("subscribing to %s: %w", filter, err)
+	}
+	return subscription, nil
+}
+
+func runWatch(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	device := args[0]
+
+	// A full device name narrows the subscription, a bare ID is matched
+	// against the devices of all types.
+	filter := a.topicPrefix() + "/+/#"
+	if info, ok := shelly.ParseTopic(a.topicPrefix() + "/" + device); ok &&
+		info.DeviceType != "" {
+		filter = a.topicPrefix() + "/" + device + "/#"
+	}
+
+	var mu sync.Mutex
+	var printErr error
+	handler := func(client MQTT.Client, message MQTT.Message) {
+		watched, info := newWatchedMessage(message)
+		if info.DeviceId != device && info.DeviceName() != device {
+			return
+		}
+		text := fmt.Sprintf(
+			"%s  %s  %s  %s",
+			watched.Time.Format("15:04:05.000"), watched.Device, watched.Subtopic,
+			formatValue(watched.Value, watched.Payload),
+		)
+		mu.Lock()
+		defer mu.Unlock()
+		if err := a.printLine(watched, text); err != nil && printErr == nil {
+			printErr = err
+		}
+	}
+	subscription, err := a.subscribe(ctx, filter, handler)
+	if err != nil {
+		return err
+	}
+	defer subscription.Unsubscribe()
+
+	<-ctx.Done()
+	mu.Lock()
+	defer mu.Unlock()
+	return printErr
+}
+
+type deviceStatus struct {
+	discoveredDevice
+	Online *bool                      `json:"online,omitempty"`
+	Values map[string]json.RawMessage `json:"values"`
+}
+
+func runStatus(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("status")
+	wait := fs.Duration("wait", 3*time.Second, "how long to collect device messages")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	var mu sync.Mutex
+	values := map[string]map[string]json.RawMessage{}
+	handler := func(client MQTT.Client, message MQTT.Message) {
+		watched, info := newWatchedMessage(message)
+		if info.DeviceType == "" {
+			return
+		}
+		value := watched.Value
+		if value == nil {
+			value, _ = json.Marshal(watched.Payload)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if values[watched.Device] == nil {
+			values[watched.Device] = map[string]json.RawMessage{}
+		}
+		values[watched.Device][watched.Subtopic] = value
+	}
+	subscription, err := a.subscribe(ctx, a.topicPrefix()+"/+/#", handler)
+	if err != nil {
+		return err
+	}
+	defer subscription.Unsubscribe()
+	// Gen1 devices publish their state when asked to update, announcements
+	// are collected by discover below.
+	updateCtx, cancel := context.WithTimeout(ctx, a.flags.timeout)
+	defer cancel()
+	if err := a.registry(a.conn).RequestUpdateCtx(updateCtx); err != nil {
+		return fmt.Errorf("asking devices to update: %w", err)
+	}
+
+	devices, err := a.discover(ctx, *wait)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	statuses := []deviceStatus{}
+	for _, d := range devices {
+		status := deviceStatus{discoveredDevice: d, Values: values[d.ID]}
+		if online, ok := status.Values["online"]; ok {
+			isOnline := string(online) == "true"
+			status.Online = &isOnline
+		}
+		statuses = append(statuses, status)
+	}
+	return a.print(statuses, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tMODEL\tIP\tONLINE\tVALUES")
+		for _, s := range statuses {
+			online := "?"
+			if s.Online != nil {
+				online = strconv.FormatBool(*s.Online)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.Model, s.IP, online, summary(s.Values))
+		}
+	})
+}
+
+// summary lists the scalar values of a device as "subtopic=value".
+func summary(values map[string]json.RawMessage) string {
+	var fields []string
+	for subtopic, value := range values {
+		if subtopic == "online" || strings.HasPrefix(string(value), "{") {
+			continue
+		}
+		fields = append(fields, subtopic+"="+formatValue(value, ""))
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, " ")
+}
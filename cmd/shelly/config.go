@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/washed/shelly-go/metering"
+)
+
+// config holds the broker settings. Flags override the environment, which
+// overrides the config file.
+type config struct {
+	Broker      string `json:"broker"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	ClientID    string `json:"client_id"`
+	TopicPrefix string `json:"topic_prefix"`
+
+	// MeterFile is where the meter command keeps its state.
+	MeterFile string `json:"meter_file"`
+	// Tariff prices the reports of the meter command.
+	Tariff   *metering.TimeOfUseTariff `json:"tariff"`
+	Currency string                    `json:"currency"`
+}
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/shelly/config.json or its
+// platform equivalent.
+func defaultConfigPath() string {
+	return configFile("config.json")
+}
+
+// configFile returns the path of name in the config directory of shelly.
+func configFile(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "shelly", name)
+}
+
+// loadConfig reads the config file at path. A missing file is only an error
+// if the path was given explicitly.
+func loadConfig(path string, explicit bool) (config, error) {
+	var c config
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// applyEnv overrides c with the MQTT_BROKER_* environment variables that
+// are set.
+func (c *config) applyEnv() {
+	for name, field := range map[string]*string{
+		"MQTT_BROKER_URL":      &c.Broker,
+		"MQTT_BROKER_USERNAME": &c.Username,
+		"MQTT_BROKER_PASSWORD": &c.Password,
+		"MQTT_CLIENT_ID":       &c.ClientID,
+		"SHELLY_TOPIC_PREFIX":  &c.TopicPrefix,
+	} {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value
+		}
+	}
+}
+
+// globalFlags are the flags accepted before the command name.
+type globalFlags struct {
+	configPath string
+	overrides  config
+	json       bool
+	verbose    bool
+	timeout    time.Duration
+}
+
+func (g *globalFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.configPath, "config", "", "config file (default "+defaultConfigPath()+")")
+	fs.StringVar(&g.overrides.Broker, "broker", "", "MQTT broker URL, e.g. tcp://localhost:1883")
+	fs.StringVar(&g.overrides.Username, "user", "", "MQTT username")
+	fs.StringVar(&g.overrides.Password, "password", "", "MQTT password")
+	fs.StringVar(&g.overrides.ClientID, "client-id", "", "MQTT client ID")
+	fs.StringVar(&g.overrides.TopicPrefix, "prefix", "", "topic prefix of the devices")
+	fs.BoolVar(&g.json, "json", false, "print results as JSON")
+	fs.BoolVar(&g.verbose, "v", false, "log library messages to stderr")
+	fs.DurationVar(&g.timeout, "timeout", 10*time.Second, "how long to wait for commands")
+}
+
+// resolve merges the config file, the environment and the flags.
+func (g *globalFlags) resolve() (config, error) {
+	path, explicit := g.configPath, g.configPath != ""
+	if !explicit {
+		if env, ok := os.LookupEnv("SHELLY_CONFIG"); ok {
+			path, explicit = env, true
+		} else {
+			path = defaultConfigPath()
+		}
+	}
+	c, err := loadConfig(path, explicit)
+	if err != nil {
+		return c, err
+	}
+	c.applyEnv()
+
+	o := g.overrides
+	for _, override := range []struct{ dst, src *string }{
+		{&c.Broker, &o.Broker},
+		{&c.Username, &o.Username},
+		{&c.Password, &o.Password},
+		{&c.ClientID, &o.ClientID},
+		{&c.TopicPrefix, &o.TopicPrefix},
+	} {
+		if *override.src != "" {
+			*override.dst = *override.src
+		}
+	}
+	return c, nil
+}
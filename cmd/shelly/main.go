@@ -0,0 +1,194 @@
+// Command shelly controls and inspects Shelly devices over MQTT.
+//
+//	shelly discover
+//	shelly plug on EF6948
+//	shelly trv set-target 60A423DAE8DE 21.5
+//	shelly watch shellyplug-s-EF6948
+//	shelly status
+//	shelly meter record
+//	shelly meter report -period month
+//
+// The broker is read from flags, the MQTT_BROKER_URL, MQTT_BROKER_USERNAME
+// and MQTT_BROKER_PASSWORD environment variables and a JSON config file, in
+// that order of precedence. The config file defaults to
+// $XDG_CONFIG_HOME/shelly/config.json and may be set with -config or
+// SHELLY_CONFIG:
+//
+//	{"broker": "tcp://localhost:1883", "username": "shelly", "password": "..."}
+//
+// The meter command also reads "meter_file", where it keeps the consumption
+// of the plugs, "currency" and a "tariff" with a default price per kWh and
+// optional time-of-use periods:
+//
+//	{"tariff": {"default": 0.32, "periods": [{"start": "22:00", "end": "06:00", "price": 0.24}]}}
+//
+// With -json every command prints JSON, watch one object per line.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	shelly "github.com/washed/shelly-go"
+)
+
+// command is a subcommand such as "discover" or "plug".
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, a *app, args []string) error
+}
+
+var commands = []command{
+	{"discover", "discover [-wait duration]", runDiscover},
+	{"plug", "plug on|off [-no-confirm] <id>", runPlug},
+	{"trv", "trv set-target [-no-confirm] <id> <°C>", runTRV},
+	{"watch", "watch <id|name>", runWatch},
+	{"status", "status [-wait duration]", runStatus},
+	{"meter", "meter record [-save duration] [-wait duration] [<id>...]\n" +
+		"  shelly meter report [-period hour|day|month] [-from date] [-to date] [<id>...]",
+		runMeter},
+}
+
+// errUsage makes the command print its usage and exit with status 2.
+var errUsage = errors.New("usage")
+
+// app is the state shared by all commands.
+type app struct {
+	flags  globalFlags
+	config config
+	out    io.Writer
+	errOut io.Writer
+	conn   *shelly.ConnectionManager
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	a := &app{out: stdout, errOut: stderr}
+	fs := flag.NewFlagSet("shelly", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	a.flags.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: shelly [flags] <command> [args]\n\ncommands:")
+		for _, cmd := range commands {
+			fmt.Fprintln(stderr, "  shelly", cmd.usage)
+		}
+		fmt.Fprintln(stderr, "\nflags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == fs.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "shelly: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+
+	config, err := a.flags.resolve()
+	if err != nil {
+		fmt.Fprintln(stderr, "shelly:", err)
+		return 1
+	}
+	a.config = config
+	if a.flags.verbose {
+		shelly.SetDefaultLogger(zerolog.New(
+			zerolog.ConsoleWriter{Out: stderr, TimeFormat: time.RFC3339Nano},
+		).With().Timestamp().Logger())
+	}
+	defer a.close()
+
+	err = cmd.run(ctx, a, fs.Args()[1:])
+	if errors.Is(err, errUsage) {
+		if err != errUsage {
+			fmt.Fprintln(stderr, "shelly:", err)
+		}
+		fmt.Fprintln(stderr, "usage: shelly", cmd.usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "shelly:", err)
+		return 1
+	}
+	return 0
+}
+
+// connect returns the connection to the broker, connecting on first use.
+func (a *app) connect(ctx context.Context) (*shelly.ConnectionManager, error) {
+	if a.conn != nil {
+		return a.conn, nil
+	}
+	if a.config.Broker == "" {
+		return nil, errors.New(
+			"no broker configured, use -broker, MQTT_BROKER_URL or a config file",
+		)
+	}
+	mqttOpts := MQTT.NewClientOptions()
+	mqttOpts.AddBroker(a.config.Broker)
+	mqttOpts.SetUsername(a.config.Username)
+	mqttOpts.SetPassword(a.config.Password)
+	if a.config.ClientID != "" {
+		mqttOpts.SetClientID(a.config.ClientID)
+	}
+
+	conn := shelly.NewConnectionManager(mqttOpts)
+	ctx, cancel := context.WithTimeout(ctx, a.flags.timeout)
+	defer cancel()
+	if err := conn.ConnectCtx(ctx); err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", a.config.Broker, err)
+	}
+	a.conn = conn
+	return conn, nil
+}
+
+func (a *app) close() {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+}
+
+// deviceOptions returns the options every device is created with.
+func (a *app) deviceOptions() []shelly.DeviceOption {
+	if a.config.TopicPrefix == "" {
+		return nil
+	}
+	return []shelly.DeviceOption{shelly.WithTopicPrefix(a.config.TopicPrefix)}
+}
+
+// registry returns a registry using the configured topic prefix.
+func (a *app) registry(conn *shelly.ConnectionManager) *shelly.Registry {
+	return conn.NewRegistry(shelly.WithRegistryTopicPrefix(a.topicPrefix()))
+}
+
+// topicPrefix returns the configured topic prefix or the Shelly default.
+func (a *app) topicPrefix() string {
+	if a.config.TopicPrefix == "" {
+		return "shellies"
+	}
+	return a.config.TopicPrefix
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	shelly "github.com/washed/shelly-go"
+	"github.com/washed/shelly-go/metering"
+)
+
+func runMeter(ctx context.Context, a *app, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "record":
+		return runMeterRecord(ctx, a, args[1:])
+	case "report":
+		return runMeterReport(a, args[1:])
+	default:
+		return errUsage
+	}
+}
+
+// meterFile returns the meter file from the config, by default meter.json
+// next to the config file.
+func (a *app) meterFile() string {
+	if a.config.MeterFile != "" {
+		return a.config.MeterFile
+	}
+	return configFile("meter.json")
+}
+
+func runMeterRecord(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("meter record")
+	save := fs.Duration("save", time.Minute, "how often to save the meter file")
+	wait := fs.Duration("wait", 2*time.Second, "how long to discover plugs if none are given")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	ids := fs.Args()
+	if len(ids) == 0 {
+		devices, err := a.discover(ctx, *wait)
+		if err != nil {
+			return err
+		}
+		for _, d := range devices {
+			if d.Model == "SHPLG-S" {
+				ids = append(ids, d.ID)
+			}
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("no Plug S found within %v", *wait)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.meterFile()), 0o755); err != nil {
+		return err
+	}
+	meter, err := metering.Open(a.meterFile())
+	if err != nil {
+		return err
+	}
+
+	conn, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		id := deviceId(id, "shellyplug-s")
+		name := shelly.PlugSDeviceName(id, a.deviceOptions()...)
+		plugS := conn.NewShellyPlugS(id, a.deviceOptions()...)
+		subscribeCtx, cancel := context.WithTimeout(ctx, a.flags.timeout)
+		_, err := meter.Track(subscribeCtx, plugS)
+		cancel()
+		if err != nil {
+			return err
+		}
+		result := struct {
+			Device string `json:"device"`
+		}{name}
+		if err := a.printLine(result, "metering "+name); err != nil {
+			return err
+		}
+	}
+	// A failed save is retried at the next interval, so keep recording.
+	return meter.Run(ctx, *save, func(err error) {
+		fmt.Fprintln(a.errOut, "shelly: saving meter:", err)
+	})
+}
+
+func runMeterReport(a *app, args []string) error {
+	now := time.Now()
+	fs := newFlagSet("meter report")
+	periodFlag := fs.String("period", "day", "length of the report rows: hour, day or month")
+	fromFlag := fs.String("from", "", "first day of the report, by default the first of the month")
+	toFlag := fs.String("to", "", "last day of the report, by default today")
+	price := fs.Float64("price", 0, "flat price per kWh, overriding the configured tariff")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	period, err := metering.ParsePeriod(*periodFlag)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	if *fromFlag != "" {
+		if from, err = time.ParseInLocation("2006-01-02", *fromFlag, time.Local); err != nil {
+			return fmt.Errorf("%w: invalid -from date %q", errUsage, *fromFlag)
+		}
+	}
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if *toFlag != "" {
+		if to, err = time.ParseInLocation("2006-01-02", *toFlag, time.Local); err != nil {
+			return fmt.Errorf("%w: invalid -to date %q", errUsage, *toFlag)
+		}
+	}
+	// Include the whole last day.
+	to = to.AddDate(0, 0, 1)
+
+	var opts []metering.Option
+	switch {
+	case *price != 0:
+		opts = append(opts, metering.WithTariff(metering.FlatTariff(*price)))
+	case a.config.Tariff != nil:
+		opts = append(opts, metering.WithTariff(*a.config.Tariff))
+	}
+	meter, err := metering.Open(a.meterFile(), opts...)
+	if err != nil {
+		return err
+	}
+
+	// Name the devices like record does.
+	var devices []string
+	for _, id := range fs.Args() {
+		devices = append(
+			devices, shelly.PlugSDeviceName(deviceId(id, "shellyplug-s"), a.deviceOptions()...),
+		)
+	}
+	report := meter.Report(from, to, period, devices...)
+
+	layout := map[metering.Period]string{
+		metering.Hourly:  "2006-01-02 15:04",
+		metering.Daily:   "2006-01-02",
+		metering.Monthly: "2006-01",
+	}[period]
+	currency := a.config.Currency
+	if currency != "" {
+		currency = " " + currency
+	}
+	return a.print(report, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "DEVICE\t%s\tKWH\tCOST\n", strings.ToUpper(period.String()))
+		for _, row := range report.Rows {
+			fmt.Fprintf(w, "%s\t%s\t%.3f\t%.2f%s\n",
+				row.Device, row.Start.Format(layout), row.KWh, row.Cost, currency)
+		}
+		fmt.Fprintf(w, "total\t\t%.3f\t%.2f%s\n", report.TotalKWh, report.TotalCost, currency)
+	})
+}
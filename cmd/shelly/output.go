@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// print writes v as indented JSON with -json and as text otherwise.
+func (a *app) print(v interface{}, text func(w *tabwriter.Writer)) error {
+	if a.flags.json {
+		encoder := json.NewEncoder(a.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	text(w)
+	return w.Flush()
+}
+
+// printLine writes v as one line of JSON with -json and as text otherwise.
+func (a *app) printLine(v interface{}, text string) error {
+	if a.flags.json {
+		return json.NewEncoder(a.out).Encode(v)
+	}
+	_, err := fmt.Fprintln(a.out, text)
+	return err
+}
+
+// formatValue renders a decoded value for text output. Objects are
+// abbreviated since they do not fit in a table.
+func formatValue(value json.RawMessage, payload string) string {
+	if value == nil {
+		return payload
+	}
+	if strings.HasPrefix(string(value), "{") {
+		return "{…}"
+	}
+	return string(value)
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"encoding/json"
 	"os"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/washed/shelly-go"
 )
 
 var (
@@ -16,23 +16,6 @@ var (
 	password = os.Getenv("MQTT_BROKER_PASSWORD")
 )
 
-func pokeAnnounce(mqttClient MQTT.Client) {
-	log.Info().
-		Msg("Poking for shelly announce")
-	topic := "shellies/command"
-	token := mqttClient.Publish(topic, byte(0), false, "announce")
-	token.Wait()
-}
-
-type ShellyAnnounce struct {
-	ID    string `json:"id"`
-	Model string `json:"model"`
-	MAC   string `json:"mac"`
-	IP    string `json:"ip"`
-	NewFW bool   `json:"new_fw"`
-	FWVer string `json:"fw_ver"`
-}
-
 func main() {
 	zerolog.TimeFieldFormat = "2006-01-02T15:04:05.000Z07:00"
 	log.Logger = log.Output(
@@ -44,52 +27,24 @@ func main() {
 	mqttOpts.SetUsername(user)
 	mqttOpts.SetPassword(password)
 
-	mqttClient := MQTT.NewClient(mqttOpts)
-
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Error().
-			Err(token.Error()).
-			Msg("Error connecting to MQTT!")
-		return
+	conn := shelly.NewConnectionManager(mqttOpts, shelly.WithLogger(log.Logger))
+	if err := conn.Connect(); err != nil {
+		log.Fatal().Err(err).Msg("Error connecting!")
 	}
-	log.Info().Msg("connected")
-
-	defer mqttClient.Disconnect(250)
-
-	topic := "shellies/announce"
-
-	callback := func(client MQTT.Client, message MQTT.Message) {
-
-		announce := ShellyAnnounce{}
-		err := json.Unmarshal(message.Payload(), &announce)
-		if err != nil {
-			log.Error().
-				Str("message.Payload", string(message.Payload())).
-				Err(err).
-				Msg("Error unmarshalling ShellyAnnounce")
-			return
-		}
+	defer conn.Close()
 
+	registry := conn.NewRegistry()
+	registry.OnEvent(func(event shelly.RegistryEvent) {
 		log.Info().
-			Interface("announce", announce).
+			Stringer("type", event.Type).
+			Interface("announce", event.Device.ShellyAnnounce).
 			Msg("Received ShellyAnnounce")
-	}
+	})
 
-	if token := mqttClient.Subscribe(topic, byte(0), callback); token.Wait() &&
-		token.Error() != nil {
-		log.Error().
-			Str("topic", topic).
-			Err(token.Error()).
-			Msg("Error subscribing!")
-		return
+	if err := registry.Discover(); err != nil {
+		log.Fatal().Err(err).Msg("Error discovering!")
 	}
 
-	log.Info().
-		Str("topic", topic).
-		Msg("Subscribed!")
-
-	pokeAnnounce(mqttClient)
-
 	for {
 		time.Sleep(time.Second * 10)
 	}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/washed/shelly-go"
+)
+
+var simButtonEvents = []string{"S", "S", "S", "L", "SS", "SSS"}
+
+// simButton1 is pressed now and then, mostly short.
+type simButton1 struct {
+	eventCount int32
+	battery    int
+}
+
+func newButton1() behavior {
+	return &simButton1{battery: 76}
+}
+
+func (b *simButton1) deviceType() string { return "shellybutton1" }
+func (b *simButton1) model() string      { return "SHBTN-1" }
+
+func (b *simButton1) tasks() []task {
+	return []task{{interval: 2 * time.Minute, run: b.press}}
+}
+
+func (b *simButton1) handleCommand(d *simDevice, subtopic string, payload string) {}
+
+func (b *simButton1) publishState(d *simDevice) {
+	d.publish("sensor/battery", fmt.Sprint(b.battery), false)
+}
+
+func (b *simButton1) press(d *simDevice) {
+	b.eventCount++
+	event := simButtonEvents[d.rand.Intn(len(simButtonEvents))]
+	d.publishJSON(d.topic("input_event/0"), shelly.ShellyButton1InputEvent{
+		Event:    event,
+		EventCnt: b.eventCount,
+	})
+	b.publishState(d)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+	"github.com/washed/shelly-go"
+)
+
+const (
+	simFirmware = "20230913-114150/v1.14.0-gcb84623"
+	// simMACPrefix pads short device IDs, which are the tail of the MAC.
+	simMACPrefix = "E868E7000000"
+)
+
+type simConfig struct {
+	broker   string
+	user     string
+	password string
+	prefix   string
+	speed    float64
+}
+
+// behavior is the model specific part of a simulated device. Its methods
+// are called with the device mutex held.
+type behavior interface {
+	deviceType() string
+	model() string
+	// publishState publishes everything the device reports on connect.
+	publishState(d *simDevice)
+	// handleCommand reacts to a message on a command topic below the
+	// device's base topic, e.g. "relay/0/command".
+	handleCommand(d *simDevice, subtopic string, payload string)
+	// tasks returns the periodic reports of the device.
+	tasks() []task
+}
+
+// task runs every interval, give or take a fifth of it.
+type task struct {
+	interval time.Duration
+	run      func(d *simDevice)
+}
+
+type simDevice struct {
+	config   simConfig
+	id       string
+	name     string
+	behavior behavior
+	client   MQTT.Client
+	started  time.Time
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	done chan struct{}
+}
+
+func newSimDevice(config simConfig, id string, behavior behavior) *simDevice {
+	d := &simDevice{
+		config:   config,
+		id:       id,
+		name:     fmt.Sprintf("%s-%s", behavior.deviceType(), id),
+		behavior: behavior,
+		started:  time.Now(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:     make(chan struct{}),
+	}
+
+	mqttOpts := MQTT.NewClientOptions()
+	mqttOpts.AddBroker(config.broker)
+	mqttOpts.SetUsername(config.user)
+	mqttOpts.SetPassword(config.password)
+	mqttOpts.SetClientID(d.name)
+	mqttOpts.SetWill(d.topic("online"), "false", 0, true)
+	mqttOpts.SetOnConnectHandler(d.onConnect)
+	d.client = MQTT.NewClient(mqttOpts)
+	return d
+}
+
+func (d *simDevice) start() error {
+	if token := d.client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	for _, t := range d.behavior.tasks() {
+		go d.schedule(t)
+	}
+	return nil
+}
+
+// stop goes offline the way a device does when it shuts down.
+func (d *simDevice) stop() {
+	close(d.done)
+	d.publish("online", "false", true)
+	d.client.Disconnect(250)
+	log.Info().Str("DeviceName", d.name).Msg("stopped")
+}
+
+func (d *simDevice) onConnect(client MQTT.Client) {
+	log.Info().Str("DeviceName", d.name).Msg("connected")
+
+	d.subscribe(d.config.prefix+"/command", d.handleGlobalCommand)
+	d.subscribe(d.topic("command"), d.handleGlobalCommand)
+	d.subscribe(d.topic("#"), d.handleDeviceMessage)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.publish("online", "true", true)
+	d.announce()
+	d.behavior.publishState(d)
+}
+
+func (d *simDevice) subscribe(topic string, handler MQTT.MessageHandler) {
+	token := d.client.Subscribe(topic, 0, handler)
+	go func() {
+		if <-token.Done(); token.Error() != nil {
+			log.Error().Str("topic", topic).Err(token.Error()).Msg("Error subscribing!")
+		}
+	}()
+}
+
+// handleGlobalCommand answers the commands every Gen1 device understands on
+// shellies/command and its own command topic.
+func (d *simDevice) handleGlobalCommand(client MQTT.Client, message MQTT.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch string(message.Payload()) {
+	case "announce":
+		d.announce()
+	case "update":
+		d.behavior.publishState(d)
+	}
+}
+
+func (d *simDevice) handleDeviceMessage(client MQTT.Client, message MQTT.Message) {
+	subtopic := strings.TrimPrefix(message.Topic(), d.topic(""))
+	if subtopic == "command" || !strings.Contains("/"+subtopic+"/", "/command/") {
+		// The device's own reports, or handled by handleGlobalCommand.
+		return
+	}
+
+	log.Info().
+		Str("DeviceName", d.name).
+		Str("command", subtopic).
+		Str("payload", string(message.Payload())).
+		Msg("received command")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.behavior.handleCommand(d, subtopic, string(message.Payload()))
+}
+
+func (d *simDevice) mac() string {
+	mac := d.id
+	if len(mac) < len(simMACPrefix) {
+		mac = simMACPrefix[:len(simMACPrefix)-len(mac)] + mac
+	}
+	return strings.ToUpper(mac)
+}
+
+func (d *simDevice) announce() {
+	d.publishJSON(d.config.prefix+"/announce", shelly.ShellyAnnounce{
+		ID:    d.name,
+		Model: d.behavior.model(),
+		MAC:   d.mac(),
+		IP:    "127.0.0.1",
+		FWVer: simFirmware,
+	})
+}
+
+// info returns the info fields shared by all device types.
+func (d *simDevice) info() shelly.ShellyInfo {
+	now := time.Now()
+	return shelly.ShellyInfo{
+		WifiSta: shelly.ShellyInfoWifiSta{
+			Connected: true,
+			SSID:      "sim",
+			IP:        "127.0.0.1",
+			RSSI:      -50,
+		},
+		MQTT:     shelly.ShellyInfoMQTT{Connected: true},
+		Time:     now.Format("15:04"),
+		Unixtime: now.Unix(),
+		MAC:      d.mac(),
+		Update: shelly.ShellyInfoUpdate{
+			Status:     "idle",
+			NewVersion: simFirmware,
+			OldVersion: simFirmware,
+		},
+		Uptime: int(now.Sub(d.started).Seconds()),
+		FwInfo: shelly.ShellyInfoFwInfo{Device: d.name, Fw: simFirmware},
+	}
+}
+
+func (d *simDevice) schedule(t task) {
+	for {
+		interval := float64(t.interval) / d.config.speed
+		d.mu.Lock()
+		interval *= 0.8 + 0.4*d.rand.Float64()
+		d.mu.Unlock()
+
+		select {
+		case <-time.After(time.Duration(interval)):
+		case <-d.done:
+			return
+		}
+
+		d.mu.Lock()
+		t.run(d)
+		d.mu.Unlock()
+	}
+}
+
+func (d *simDevice) topic(subtopic string) string {
+	return fmt.Sprintf("%s/%s/%s", d.config.prefix, d.name, subtopic)
+}
+
+// publish publishes below the device's base topic. It must not wait for the
+// broker, as it runs in message handlers.
+func (d *simDevice) publish(subtopic string, payload interface{}, retained bool) {
+	d.publishTopic(d.topic(subtopic), payload, retained)
+}
+
+func (d *simDevice) publishJSON(topic string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Error().Err(err).Str("topic", topic).Msg("Error encoding payload!")
+		return
+	}
+	d.publishTopic(topic, payload, false)
+}
+
+func (d *simDevice) publishTopic(topic string, payload interface{}, retained bool) {
+	token := d.client.Publish(topic, 0, retained, payload)
+	go func() {
+		if <-token.Done(); token.Error() != nil {
+			log.Error().Str("topic", topic).Err(token.Error()).Msg("Error publishing!")
+		}
+	}()
+}
+
+// jitter returns value changed by up to ±spread.
+func (d *simDevice) jitter(value float32, spread float32) float32 {
+	return value + spread*(2*d.rand.Float32()-1)
+}
+
+func formatFloat(value float32) string {
+	return fmt.Sprintf("%.2f", value)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/washed/shelly-go"
+)
+
+// simDW2 is tilted, opened and closed now and then. Like the battery
+// powered device it only reports when it wakes up.
+type simDW2 struct {
+	step        int
+	lux         int
+	temperature float32
+	battery     int
+}
+
+func newDW2() behavior {
+	return &simDW2{lux: 120, temperature: 21, battery: 98}
+}
+
+func (w *simDW2) deviceType() string { return "shellydw2" }
+func (w *simDW2) model() string      { return "SHDW-2" }
+
+func (w *simDW2) tasks() []task {
+	return []task{{interval: 3 * time.Minute, run: w.toggle}}
+}
+
+func (w *simDW2) handleCommand(d *simDevice, subtopic string, payload string) {}
+
+// simWindowPositions is the order the window goes through, closing it
+// between tilting and opening it fully.
+var simWindowPositions = []shelly.WindowPosition{
+	shelly.WindowClosed, shelly.WindowTilted, shelly.WindowClosed, shelly.WindowOpen,
+}
+
+func (w *simDW2) toggle(d *simDevice) {
+	w.step = (w.step + 1) % len(simWindowPositions)
+	w.lux = int(d.jitter(float32(w.lux), 20))
+	if w.lux < 0 {
+		w.lux = 0
+	}
+	w.temperature = d.jitter(w.temperature, 0.3)
+	w.publishState(d)
+}
+
+func (w *simDW2) publishState(d *simDevice) {
+	// A tilted window reports a few degrees of tilt, one turned fully open
+	// the same as a closed one.
+	state := "open"
+	tilt := 0
+	switch simWindowPositions[w.step] {
+	case shelly.WindowClosed:
+		state = "close"
+	case shelly.WindowTilted:
+		tilt = shelly.DefaultWindowCalibration.TiltedAngle
+	}
+	illumination := "dark"
+	switch {
+	case w.lux > 400:
+		illumination = "bright"
+	case w.lux > 100:
+		illumination = "twilight"
+	}
+
+	d.publish("sensor/state", state, false)
+	d.publish("sensor/tilt", fmt.Sprint(tilt), false)
+	d.publish("sensor/vibration", "0", false)
+	d.publish("sensor/lux", fmt.Sprint(w.lux), false)
+	d.publish("sensor/illumination", illumination, false)
+	d.publish("sensor/temperature", formatFloat(w.temperature), false)
+	d.publish("sensor/battery", fmt.Sprint(w.battery), false)
+	d.publish("sensor/error", "0", false)
+	d.publishJSON(d.topic("info"), shelly.ShellyDW2Info{
+		ShellyInfo: d.info(),
+		IsValid:    true,
+		Sensor:     shelly.ShellyDW2Sensor{State: state, IsValid: true},
+		Bat:        shelly.ShellyInfoBat{Value: w.battery, Voltage: 5.9},
+		Tmp:        shelly.ShellyInfoTmp{Value: w.temperature, Units: "C", IsValid: true},
+		Lux: shelly.ShellyInfoLux{
+			Value:        float32(w.lux),
+			Illumination: illumination,
+			IsValid:      true,
+		},
+		Accel:      shelly.ShellyDW2Accel{Tilt: tilt, Vibration: 0},
+		ActReasons: []string{shelly.WakeReasonSensor},
+	})
+}
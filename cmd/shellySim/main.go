@@ -0,0 +1,86 @@
+// Command shellySim emulates Gen1 Shelly devices against an MQTT broker, so
+// automations can be developed without hardware.
+//
+// Every simulated device keeps its own connection with a last will on its
+// online topic, publishes its state periodically, answers announce and
+// update requests and reacts to commands like the real device.
+//
+//	shellySim -trv 60A423DAE8DE -plugs EF6948,EF6949 -dw2 C92B94 -button1 3C6105E51C74
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	broker   = os.Getenv("MQTT_BROKER_URL")
+	user     = os.Getenv("MQTT_BROKER_USERNAME")
+	password = os.Getenv("MQTT_BROKER_PASSWORD")
+)
+
+func main() {
+	var (
+		trvs     = flag.String("trv", "", "comma separated IDs of simulated TRVs")
+		plugs    = flag.String("plugs", "", "comma separated IDs of simulated Plug S")
+		dw2s     = flag.String("dw2", "", "comma separated IDs of simulated Door/Window 2")
+		buttons  = flag.String("button1", "", "comma separated IDs of simulated Button1")
+		prefix   = flag.String("prefix", "shellies", "topic prefix")
+		speed    = flag.Float64("speed", 1, "time acceleration of the periodic reports")
+		brokerFl = flag.String("broker", broker, "broker URL, defaults to $MQTT_BROKER_URL")
+	)
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	log.Logger = log.Output(
+		zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339Nano},
+	)
+
+	if *speed <= 0 {
+		log.Fatal().Float64("speed", *speed).Msg("speed must be positive")
+	}
+	config := simConfig{
+		broker:   *brokerFl,
+		user:     user,
+		password: password,
+		prefix:   *prefix,
+		speed:    *speed,
+	}
+
+	var devices []*simDevice
+	add := func(ids string, newBehavior func() behavior) {
+		for _, id := range strings.Split(ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				devices = append(devices, newSimDevice(config, id, newBehavior()))
+			}
+		}
+	}
+	add(*trvs, newTRV)
+	add(*plugs, newPlugS)
+	add(*dw2s, newDW2)
+	add(*buttons, newButton1)
+	if len(devices) == 0 {
+		log.Fatal().Msg("nothing to simulate, pass at least one of -trv, -plugs, -dw2, -button1")
+	}
+
+	for _, device := range devices {
+		if err := device.start(); err != nil {
+			log.Fatal().Err(err).Str("DeviceName", device.name).Msg("Error connecting!")
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	for _, device := range devices {
+		device.stop()
+	}
+}
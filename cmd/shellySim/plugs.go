@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// simPlugS switches a load of a fixed nominal power.
+type simPlugS struct {
+	on          bool
+	load        float32
+	power       float32
+	energy      float64 // watt-minutes, like the device reports
+	temperature float32
+	lastEnergy  time.Time
+}
+
+func newPlugS() behavior {
+	return &simPlugS{on: true, load: 60, temperature: 30, lastEnergy: time.Now()}
+}
+
+func (p *simPlugS) deviceType() string { return "shellyplug-s" }
+func (p *simPlugS) model() string      { return "SHPLG-S" }
+
+func (p *simPlugS) tasks() []task {
+	return []task{{interval: 30 * time.Second, run: p.report}}
+}
+
+func (p *simPlugS) publishState(d *simDevice) {
+	p.publishRelay(d)
+	p.publishMeter(d)
+}
+
+func (p *simPlugS) handleCommand(d *simDevice, subtopic string, payload string) {
+	if subtopic != "relay/0/command" {
+		return
+	}
+	switch payload {
+	case "on":
+		p.on = true
+	case "off":
+		p.on = false
+	case "toggle":
+		p.on = !p.on
+	default:
+		return
+	}
+	p.publishRelay(d)
+	p.publishMeter(d)
+}
+
+func (p *simPlugS) report(d *simDevice) {
+	p.temperature = d.jitter(p.temperature, 0.2)
+	p.publishState(d)
+}
+
+func (p *simPlugS) publishRelay(d *simDevice) {
+	state := "off"
+	if p.on {
+		state = "on"
+	}
+	d.publish("relay/0", state, false)
+}
+
+func (p *simPlugS) publishMeter(d *simDevice) {
+	now := time.Now()
+	p.energy += float64(p.power) * now.Sub(p.lastEnergy).Minutes() * d.config.speed
+	p.lastEnergy = now
+
+	p.power = 0
+	if p.on {
+		p.power = d.jitter(p.load, p.load/20)
+	}
+	d.publish("relay/0/power", formatFloat(p.power), false)
+	d.publish("relay/0/energy", strconv.FormatFloat(p.energy, 'f', 2, 64), false)
+	d.publish("temperature", formatFloat(p.temperature), false)
+	d.publish("temperature_f", formatFloat(p.temperature*9/5+32), false)
+	d.publish("overtemperature", "0", false)
+}
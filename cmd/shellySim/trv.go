@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/washed/shelly-go"
+)
+
+// simTRV heats towards its target temperature, opening the valve the
+// further the room is below the target unless the valve was set manually.
+type simTRV struct {
+	target      float32
+	temperature float32
+	valve       float32
+	manualValve bool
+	schedule    bool
+	battery     int
+}
+
+func newTRV() behavior {
+	return &simTRV{target: 20, temperature: 18.5, battery: 87}
+}
+
+func (t *simTRV) deviceType() string { return "shellytrv" }
+func (t *simTRV) model() string      { return "SHTRV-01" }
+
+func (t *simTRV) tasks() []task {
+	return []task{
+		{interval: time.Minute, run: t.step},
+		{interval: 5 * time.Minute, run: t.publishInfo},
+	}
+}
+
+func (t *simTRV) publishState(d *simDevice) {
+	t.publishStatus(d)
+	t.publishInfo(d)
+}
+
+func (t *simTRV) handleCommand(d *simDevice, subtopic string, payload string) {
+	value, err := strconv.ParseFloat(payload, 32)
+	number := float32(value)
+
+	switch subtopic {
+	case "thermostat/0/command/target_t":
+		if err != nil || number < 4 || number > 31 {
+			return
+		}
+		t.target = number
+		t.manualValve = false
+		t.regulate()
+	case "thermostat/0/command/valve_pos":
+		if err != nil || number < 0 || number > 100 {
+			return
+		}
+		t.valve = number
+		t.manualValve = true
+	case "thermostat/0/command/ext_t":
+		if err != nil {
+			return
+		}
+		t.temperature = number
+		t.regulate()
+	case "thermostat/0/command/schedule":
+		t.schedule = payload == "1"
+	case "thermostat/0/command/settings":
+	default:
+		return
+	}
+	t.publishState(d)
+}
+
+// step moves the room temperature a little towards what the valve allows.
+func (t *simTRV) step(d *simDevice) {
+	switch {
+	case t.valve > 0 && t.temperature < t.target+0.5:
+		t.temperature += 0.1 * t.valve / 100
+	case t.valve == 0:
+		t.temperature -= 0.05
+	}
+	t.temperature = d.jitter(t.temperature, 0.02)
+	t.regulate()
+	t.publishStatus(d)
+}
+
+func (t *simTRV) regulate() {
+	if t.manualValve {
+		return
+	}
+	valve := (t.target - t.temperature) * 40
+	switch {
+	case valve < 0:
+		valve = 0
+	case valve > 100:
+		valve = 100
+	}
+	t.valve = float32(int(valve))
+}
+
+func (t *simTRV) publishStatus(d *simDevice) {
+	d.publishJSON(d.topic("status"), shelly.ShellyTRVStatus{
+		TargetT: shelly.ShellyTRVTargetT{Enabled: true, Value: t.target, Units: "C"},
+		Tmp:     shelly.ShellyInfoTmp{Value: t.temperature, Units: "C", IsValid: true},
+		Bat:     float32(t.battery),
+	})
+}
+
+func (t *simTRV) publishInfo(d *simDevice) {
+	d.publishJSON(d.topic("info"), shelly.ShellyTRVInfo{
+		ShellyInfo: d.info(),
+		Calibrated: true,
+		Thermostats: []shelly.ShellyTRVThermostat{{
+			Pos:      t.valve,
+			Schedule: t.schedule,
+			TargetT:  shelly.ShellyTRVTargetT{Enabled: true, Value: t.target, Units: "C"},
+			Tmp:      shelly.ShellyInfoTmp{Value: t.temperature, Units: "C", IsValid: true},
+		}},
+		Bat: shelly.ShellyInfoBat{Value: t.battery, Voltage: 3.9},
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// change is a field that differs between two consecutive messages of a topic.
+type change struct {
+	Path string `json:"path"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+func (c change) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("%s: + %s", c.Path, c.New)
+	case c.New == "":
+		return fmt.Sprintf("%s: - %s", c.Path, c.Old)
+	default:
+		return fmt.Sprintf("%s: %s → %s", c.Path, c.Old, c.New)
+	}
+}
+
+// differ remembers the last JSON object seen on each topic.
+type differ struct {
+	last map[string]map[string]string
+}
+
+func newDiffer() *differ {
+	return &differ{last: make(map[string]map[string]string)}
+}
+
+// diff returns the fields of value that changed since the previous message on
+// topic. It reports false for the first message of a topic and for values
+// that are not JSON objects.
+func (d *differ) diff(topic string, value json.RawMessage) ([]change, bool) {
+	var decoded interface{}
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return nil, false
+	}
+	if _, ok := decoded.(map[string]interface{}); !ok {
+		return nil, false
+	}
+	fields := make(map[string]string)
+	flatten("", decoded, fields)
+
+	last, ok := d.last[topic]
+	d.last[topic] = fields
+	if !ok {
+		return nil, false
+	}
+
+	var changes []change
+	for path, cur := range fields {
+		if old := last[path]; old != cur {
+			changes = append(changes, change{Path: path, Old: old, New: cur})
+		}
+	}
+	for path, old := range last {
+		if _, ok := fields[path]; !ok {
+			changes = append(changes, change{Path: path, Old: old})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, true
+}
+
+// flatten stores the leaves of a decoded JSON value under dotted paths such
+// as "tmp.value" or "sensors.0.id".
+func flatten(prefix string, value interface{}, out map[string]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flatten(join(key), child, out)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten(join(strconv.Itoa(i)), child, out)
+		}
+	default:
+		leaf, _ := json.Marshal(v)
+		out[prefix] = string(leaf)
+	}
+}
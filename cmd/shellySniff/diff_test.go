@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDifferDiff(t *testing.T) {
+	const topic = "shellies/shellytrv-B2/info"
+	tests := []struct {
+		name     string
+		previous string
+		value    string
+		want     []change
+		wantOk   bool
+	}{
+		{name: "first message", value: `{"a":1}`},
+		{name: "not an object", previous: `{"a":1}`, value: `42`},
+		{name: "unchanged", previous: `{"a":1}`, value: `{"a":1}`, wantOk: true},
+		{
+			name:     "changed added removed",
+			previous: `{"a":1,"b":"x","c":true}`,
+			value:    `{"a":2,"c":true,"d":null}`,
+			want: []change{
+				{Path: "a", Old: "1", New: "2"},
+				{Path: "b", Old: `"x"`},
+				{Path: "d", New: "null"},
+			},
+			wantOk: true,
+		},
+		{
+			name:     "nested",
+			previous: `{"tmp":{"value":20.5},"sensors":[{"id":1}]}`,
+			value:    `{"tmp":{"value":21},"sensors":[{"id":1},{"id":2}]}`,
+			want: []change{
+				{Path: "sensors.1.id", New: "2"},
+				{Path: "tmp.value", Old: "20.5", New: "21"},
+			},
+			wantOk: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDiffer()
+			if test.previous != "" {
+				d.diff(topic, json.RawMessage(test.previous))
+			}
+			got, ok := d.diff(topic, json.RawMessage(test.value))
+			if ok != test.wantOk || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, %v, want %v, %v", got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestDifferTopics(t *testing.T) {
+	d := newDiffer()
+	d.diff("a", json.RawMessage(`{"x":1}`))
+	if _, ok := d.diff("b", json.RawMessage(`{"x":2}`)); ok {
+		t.Error("want the first message of another topic not to be diffed")
+	}
+}
+
+func TestChangeString(t *testing.T) {
+	tests := []struct {
+		change change
+		want   string
+	}{
+		{change{Path: "a", Old: "1", New: "2"}, "a: 1 → 2"},
+		{change{Path: "b", New: `"x"`}, `b: + "x"`},
+		{change{Path: "c", Old: "true"}, "c: - true"},
+	}
+	for _, test := range tests {
+		if got := test.change.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
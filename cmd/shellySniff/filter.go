@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	shelly "github.com/washed/shelly-go"
+)
+
+// listFlag collects a flag given several times or as a comma separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// messageFilter selects the messages shellySniff prints. Every configured
+// criterion has to match; criteria with several values match if any value
+// does.
+type messageFilter struct {
+	globs       []string
+	regex       *regexp.Regexp
+	deviceTypes map[string]bool
+	ids         map[string]bool
+}
+
+func newMessageFilter(globs []string, regex string, models []string, ids []string) (
+	*messageFilter,
+	error,
+) {
+	f := &messageFilter{globs: globs}
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid topic glob %q: %w", glob, err)
+		}
+	}
+	if regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic regex: %w", err)
+		}
+		f.regex = re
+	}
+	if len(models) > 0 {
+		f.deviceTypes = make(map[string]bool, len(models))
+		for _, model := range models {
+			// Accept both the model, e.g. SHPLG-S, and the device type used
+			// in topics, e.g. shellyplug-s.
+			if deviceType, ok := shelly.DeviceTypeForModel(model); ok {
+				model = deviceType
+			}
+			f.deviceTypes[strings.ToLower(model)] = true
+		}
+	}
+	if len(ids) > 0 {
+		f.ids = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			f.ids[strings.ToLower(id)] = true
+		}
+	}
+	return f, nil
+}
+
+func (f *messageFilter) match(topic string, info shelly.TopicInfo) bool {
+	if len(f.globs) > 0 && !f.matchGlob(topic) {
+		return false
+	}
+	if f.regex != nil && !f.regex.MatchString(topic) {
+		return false
+	}
+	if f.deviceTypes != nil && !f.deviceTypes[info.DeviceType] {
+		return false
+	}
+	if f.ids != nil && !f.ids[strings.ToLower(info.DeviceId)] &&
+		!f.ids[strings.ToLower(info.DeviceName())] {
+		return false
+	}
+	return true
+}
+
+func (f *messageFilter) matchGlob(topic string) bool {
+	for _, glob := range f.globs {
+		if ok, _ := path.Match(glob, topic); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	shelly "github.com/washed/shelly-go"
+)
+
+func TestMessageFilterMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		globs  []string
+		regex  string
+		models []string
+		ids    []string
+		topic  string
+		want   bool
+	}{
+		{name: "no criteria", topic: "shellies/shellyplug-s-A1/relay/0", want: true},
+		{
+			name:  "glob",
+			globs: []string{"shellies/*/relay/0"},
+			topic: "shellies/shellyplug-s-A1/relay/0",
+			want:  true,
+		},
+		{
+			name:  "glob does not cross levels",
+			globs: []string{"shellies/*"},
+			topic: "shellies/shellyplug-s-A1/relay/0",
+		},
+		{
+			name:  "any glob",
+			globs: []string{"shellies/*/info", "shellies/*/relay/0"},
+			topic: "shellies/shellyplug-s-A1/relay/0",
+			want:  true,
+		},
+		{
+			name:  "regex",
+			regex: "relay/[0-9]+$",
+			topic: "shellies/shellyplug-s-A1/relay/0",
+			want:  true,
+		},
+		{
+			name:  "regex mismatch",
+			regex: "^shellies/shellydw2",
+			topic: "shellies/shellyplug-s-A1/relay/0",
+		},
+		{
+			name:   "model",
+			models: []string{"SHPLG-S"},
+			topic:  "shellies/shellyplug-s-A1/relay/0",
+			want:   true,
+		},
+		{
+			name:   "device type",
+			models: []string{"ShellyPlug-S"},
+			topic:  "shellies/shellyplug-s-A1/relay/0",
+			want:   true,
+		},
+		{
+			name:   "other model",
+			models: []string{"SHDW-2"},
+			topic:  "shellies/shellyplug-s-A1/relay/0",
+		},
+		{
+			name:  "id",
+			ids:   []string{"a1"},
+			topic: "shellies/shellyplug-s-A1/relay/0",
+			want:  true,
+		},
+		{
+			name:  "device name",
+			ids:   []string{"shellyplug-s-A1"},
+			topic: "shellies/shellyplug-s-A1/relay/0",
+			want:  true,
+		},
+		{
+			name:  "other id",
+			ids:   []string{"B2"},
+			topic: "shellies/shellyplug-s-A1/relay/0",
+		},
+		{
+			name:   "every criterion",
+			globs:  []string{"shellies/*/relay/0"},
+			models: []string{"SHPLG-S"},
+			ids:    []string{"B2"},
+			topic:  "shellies/shellyplug-s-A1/relay/0",
+		},
+		{
+			name:   "model of an unknown topic",
+			models: []string{"SHPLG-S"},
+			topic:  "shellies/announce",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := newMessageFilter(test.globs, test.regex, test.models, test.ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, _ := shelly.ParseTopic(test.topic)
+			if got := filter.match(test.topic, info); got != test.want {
+				t.Errorf("match(%q) = %v, want %v", test.topic, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewMessageFilterInvalid(t *testing.T) {
+	if _, err := newMessageFilter([]string{"shellies/["}, "", nil, nil); err == nil {
+		t.Error("want an error for an invalid glob")
+	}
+	if _, err := newMessageFilter(nil, "(", nil, nil); err == nil {
+		t.Error("want an error for an invalid regex")
+	}
+}
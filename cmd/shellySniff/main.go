@@ -1,13 +1,32 @@
+// Command shellySniff logs the traffic of Shelly devices. It can filter
+// messages by topic, model and device, decode them into the types of the
+// shelly package, show which fields changed between consecutive messages,
+// record the traffic to a capture file and replay a capture to the broker.
+//
+//	shellySniff -model SHPLG-S -decode -format jsonl
+//	shellySniff -topic 'shellies/*/info' -diff
+//	shellySniff -record session.jsonl
+//	shellySniff -replay session.jsonl -speed 10
+//	shellySniff -replay session.jsonl -model SHDW-2 -dry-run
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	shelly "github.com/washed/shelly-go"
+	"github.com/washed/shelly-go/capture"
 )
 
 var (
@@ -17,11 +36,62 @@ var (
 )
 
 func main() {
+	var (
+		topics listFlag
+		models listFlag
+		ids    listFlag
+
+		subscribe = flag.String("subscribe", "shellies/#", "MQTT topic filter to subscribe to")
+		regex     = flag.String("regex", "", "only handle messages whose topic matches this regex")
+		decode    = flag.Bool("decode", false, "decode payloads into the shelly package types")
+		diff      = flag.Bool("diff", false, "show the fields changed since the last message")
+		format    = flag.String("format", "pretty", "output format: pretty, jsonl or csv")
+		record    = flag.String("record", "", "append all received messages to a capture file")
+		replay    = flag.String("replay", "", "republish the messages of a capture file and exit")
+		speed     = flag.Float64(
+			"speed", 1, "replay speed relative to the original timing, 0 replays without delays",
+		)
+		commands = flag.Bool("replay-commands", false, "also replay messages on command topics")
+		retain   = flag.Bool("replay-retain", false, "keep the retain flag of replayed messages")
+		dryRun   = flag.Bool("dry-run", false, "print the replayed messages instead of publishing")
+	)
+	flag.Var(&topics, "topic", "only handle messages whose topic matches one of these globs")
+	flag.Var(&models, "model", "only handle messages of these models or device types")
+	flag.Var(&ids, "id", "only handle messages of these device IDs or names")
+	flag.Parse()
+
+	// Keep stdout clean for machine readable formats.
+	var logOut io.Writer = os.Stdout
+	if *format != "pretty" {
+		logOut = os.Stderr
+	}
 	zerolog.TimeFieldFormat = "2006-01-02T15:04:05.000Z07:00"
 	log.Logger = log.Output(
-		zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339Nano},
+		zerolog.ConsoleWriter{Out: logOut, TimeFormat: time.RFC3339Nano},
 	)
 
+	filter, err := newMessageFilter(topics, *regex, models, ids)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid filter!")
+	}
+	out, err := newPrinter(*format, os.Stdout, log.Logger)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid format!")
+	}
+	s := &sniffer{filter: filter, decode: *decode, printer: out}
+	if *diff {
+		s.differ = newDiffer()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	replayOpts := replayOptions{speed: *speed, commands: *commands, retain: *retain}
+	if *replay != "" && *dryRun {
+		s.replay(ctx, nil, *replay, replayOpts)
+		return
+	}
+
 	mqttOpts := MQTT.NewClientOptions()
 	mqttOpts.AddBroker(broker)
 	mqttOpts.SetUsername(user)
@@ -39,19 +109,52 @@ func main() {
 
 	defer mqttClient.Disconnect(250)
 
-	topic := "shellies/#"
-	filter := "shellybutton"
+	if *replay != "" {
+		s.replay(ctx, mqttClient, *replay, replayOpts)
+		return
+	}
+	s.run(ctx, mqttClient, *subscribe, *record)
+}
+
+// sniffer filters, decodes and prints received messages.
+type sniffer struct {
+	filter  *messageFilter
+	decode  bool
+	differ  *differ
+	printer printer
+
+	mu sync.Mutex
+}
+
+func (s *sniffer) run(ctx context.Context, mqttClient MQTT.Client, topic string, record string) {
+	var recorder MQTT.MessageHandler
+	if record != "" {
+		f, err := os.OpenFile(record, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Error().Err(err).Str("file", record).Msg("Error opening capture!")
+			return
+		}
+		defer f.Close()
+		recorder = capture.NewWriter(f).Handler(func(err error) {
+			log.Error().Err(err).Str("file", record).Msg("Error recording message!")
+		})
+		log.Info().Str("file", record).Msg("recording")
+	}
 
 	callback := func(client MQTT.Client, message MQTT.Message) {
-		if strings.Contains(message.Topic(), filter) {
-			log.Info().
-				Str("topic", message.Topic()).
-				Str("payload", string(message.Payload())).
-				Msg("Received shelly message")
+		if recorder != nil {
+			recorder(client, message)
 		}
+		s.handle(capture.FromMessage(message, time.Now()))
 	}
 
-	if token := mqttClient.Subscribe(topic, byte(0), callback); token.Wait() &&
+	// Subscribe with the highest QoS while recording, so the broker
+	// delivers and the capture keeps the QoS each message was published with.
+	qos := byte(0)
+	if record != "" {
+		qos = 2
+	}
+	if token := mqttClient.Subscribe(topic, qos, callback); token.Wait() &&
 		token.Error() != nil {
 		log.Error().
 			Str("topic", topic).
@@ -62,10 +165,45 @@ func main() {
 
 	log.Info().
 		Str("topic", topic).
-		Str("topic_filter", filter).
 		Msg("subscribed")
 
-	for {
-		time.Sleep(time.Second * 10)
+	<-ctx.Done()
+}
+
+func (s *sniffer) handle(record capture.Record) {
+	info, _ := shelly.ParseTopic(record.Topic)
+	if !s.filter.match(record.Topic, info) {
+		return
+	}
+
+	sniffed := sniffedMessage{
+		Time:     record.Time,
+		Topic:    record.Topic,
+		Device:   info.DeviceName(),
+		Subtopic: info.Subtopic,
+		Payload:  string(record.Payload),
+	}
+	diffed := json.RawMessage(record.Payload)
+	if s.decode {
+		decoded, err := shelly.DecodeMessage(record.Topic, record.Payload)
+		switch {
+		case errors.Is(err, shelly.ErrUnknownTopic):
+		case err != nil:
+			sniffed.Error = err.Error()
+		default:
+			if value, err := json.Marshal(decoded.Value); err == nil {
+				sniffed.Value = value
+				diffed = value
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.differ != nil {
+		sniffed.Changes, _ = s.differ.diff(record.Topic, diffed)
+	}
+	if err := s.printer.print(sniffed); err != nil {
+		log.Error().Err(err).Msg("Error printing message!")
 	}
 }
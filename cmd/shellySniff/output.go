@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// sniffedMessage is a received message as shellySniff prints it.
+type sniffedMessage struct {
+	Time     time.Time       `json:"time"`
+	Topic    string          `json:"topic"`
+	Device   string          `json:"device,omitempty"`
+	Subtopic string          `json:"subtopic,omitempty"`
+	Payload  string          `json:"payload"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Changes  []change        `json:"changes,omitempty"`
+}
+
+type printer interface {
+	print(message sniffedMessage) error
+}
+
+func newPrinter(format string, out io.Writer, logger zerolog.Logger) (printer, error) {
+	switch format {
+	case "pretty":
+		return prettyPrinter{logger: logger}, nil
+	case "jsonl":
+		return jsonlPrinter{encoder: json.NewEncoder(out)}, nil
+	case "csv":
+		return &csvPrinter{writer: csv.NewWriter(out)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, want pretty, jsonl or csv", format)
+	}
+}
+
+// prettyPrinter logs messages for humans.
+type prettyPrinter struct {
+	logger zerolog.Logger
+}
+
+func (p prettyPrinter) print(message sniffedMessage) error {
+	e := p.logger.Info().Str("topic", message.Topic)
+	if message.Value != nil {
+		e = e.RawJSON("value", message.Value)
+	} else {
+		e = e.Str("payload", message.Payload)
+	}
+	if message.Error != "" {
+		e = e.Str("decode_error", message.Error)
+	}
+	if message.Changes != nil {
+		changed := make([]string, len(message.Changes))
+		for i, c := range message.Changes {
+			changed[i] = c.String()
+		}
+		e = e.Strs("changed", changed)
+	}
+	e.Msg("Received shelly message")
+	return nil
+}
+
+// jsonlPrinter writes one JSON object per message.
+type jsonlPrinter struct {
+	encoder *json.Encoder
+}
+
+func (p jsonlPrinter) print(message sniffedMessage) error {
+	return p.encoder.Encode(message)
+}
+
+// csvPrinter writes a header and one row per message.
+type csvPrinter struct {
+	writer      *csv.Writer
+	wroteHeader bool
+}
+
+func (p *csvPrinter) print(message sniffedMessage) error {
+	if !p.wroteHeader {
+		header := []string{
+			"time", "topic", "device", "subtopic", "payload", "value", "error", "changes",
+		}
+		if err := p.writer.Write(header); err != nil {
+			return err
+		}
+		p.wroteHeader = true
+	}
+	changes := make([]string, len(message.Changes))
+	for i, c := range message.Changes {
+		changes[i] = c.String()
+	}
+	err := p.writer.Write([]string{
+		message.Time.Format(time.RFC3339Nano),
+		message.Topic,
+		message.Device,
+		message.Subtopic,
+		message.Payload,
+		string(message.Value),
+		message.Error,
+		strings.Join(changes, "; "),
+	})
+	if err != nil {
+		return err
+	}
+	p.writer.Flush()
+	return p.writer.Error()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+	shelly "github.com/washed/shelly-go"
+	"github.com/washed/shelly-go/capture"
+)
+
+// replayOptions controls which records of a capture are replayed and how.
+type replayOptions struct {
+	speed float64
+	// commands replays messages on command topics too. They are skipped by
+	// default, as replaying them would switch real devices.
+	commands bool
+	// retain keeps the retain flag of replayed messages. It is dropped by
+	// default, so a replay does not leave stale state on the broker.
+	retain bool
+}
+
+// selectRecords returns the records of a capture to replay.
+func selectRecords(
+	records []capture.Record,
+	filter *messageFilter,
+	opts replayOptions,
+) []capture.Record {
+	var selected []capture.Record
+	for _, record := range records {
+		if !opts.commands && isCommandTopic(record.Topic) {
+			continue
+		}
+		info, _ := shelly.ParseTopic(record.Topic)
+		if !filter.match(record.Topic, info) {
+			continue
+		}
+		if !opts.retain {
+			record.Retained = false
+		}
+		selected = append(selected, record)
+	}
+	return selected
+}
+
+// isCommandTopic reports whether topic sends commands to devices, e.g.
+// shellies/command or shellies/<device>/relay/0/command.
+func isCommandTopic(topic string) bool {
+	for _, level := range strings.Split(topic, "/") {
+		if level == "command" {
+			return true
+		}
+	}
+	return false
+}
+
+// replay republishes the selected records of a capture file on mqttClient,
+// or prints them if mqttClient is nil.
+func (s *sniffer) replay(
+	ctx context.Context,
+	mqttClient MQTT.Client,
+	file string,
+	opts replayOptions,
+) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Error().Err(err).Str("file", file).Msg("Error opening capture!")
+		return
+	}
+	defer f.Close()
+
+	records, err := capture.ReadAll(f)
+	if err != nil {
+		log.Error().Err(err).Str("file", file).Msg("Error reading capture!")
+		return
+	}
+	selected := selectRecords(records, s.filter, opts)
+	log.Info().
+		Str("file", file).
+		Int("messages", len(selected)).
+		Int("skipped", len(records)-len(selected)).
+		Float64("speed", opts.speed).
+		Bool("dryRun", mqttClient == nil).
+		Msg("replaying")
+
+	publish := func(record capture.Record) error {
+		s.handle(record)
+		return nil
+	}
+	if mqttClient != nil {
+		publish = capture.Publisher(ctx, mqttClient)
+	}
+	err = capture.Replay(ctx, selected, opts.speed, func(record capture.Record) error {
+		if mqttClient != nil {
+			log.Info().
+				Str("topic", record.Topic).
+				Str("payload", string(record.Payload)).
+				Msg("Replaying shelly message")
+		}
+		return publish(record)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Error replaying capture!")
+		return
+	}
+	log.Info().Msg("replay done")
+}
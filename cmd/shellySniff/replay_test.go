@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/washed/shelly-go/capture"
+)
+
+func TestSelectRecords(t *testing.T) {
+	records := []capture.Record{
+		{Topic: "shellies/shellyplug-s-A1/relay/0", Retained: true},
+		{Topic: "shellies/shellyplug-s-A1/relay/0/command"},
+		{Topic: "shellies/command"},
+		{Topic: "shellies/shellytrv-B2/thermostat/0/command/target_t"},
+		{Topic: "shellies/shellydw2-C3/sensor/state", Retained: true},
+	}
+	all, err := newMessageFilter(nil, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugs, err := newMessageFilter(nil, "", []string{"SHPLG-S"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter *messageFilter
+		opts   replayOptions
+		want   []capture.Record
+	}{
+		{
+			name:   "default",
+			filter: all,
+			want: []capture.Record{
+				{Topic: "shellies/shellyplug-s-A1/relay/0"},
+				{Topic: "shellies/shellydw2-C3/sensor/state"},
+			},
+		},
+		{
+			name:   "commands and retain",
+			filter: plugs,
+			opts:   replayOptions{commands: true, retain: true},
+			want: []capture.Record{
+				{Topic: "shellies/shellyplug-s-A1/relay/0", Retained: true},
+				{Topic: "shellies/shellyplug-s-A1/relay/0/command"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := selectRecords(records, test.filter, test.opts)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ func main() {
 	log.Logger = log.Output(
 		zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339Nano},
 	)
+	shelly.SetDefaultLogger(log.Logger)
 
 	mqttOpts := MQTT.NewClientOptions()
 	mqttOpts.AddBroker(broker)
@@ -28,7 +29,9 @@ func main() {
 	mqttOpts.SetPassword(password)
 
 	button1 := shelly.NewShellyButton1("3C6105E51C74", mqttOpts)
-	button1.Connect()
+	if err := button1.Connect(); err != nil {
+		log.Fatal().Err(err).Msg("Error connecting!")
+	}
 	defer button1.Close()
 
 	button1.SubscribeInputEventRaw(func(inputEvent shelly.ShellyButton1InputEvent) {
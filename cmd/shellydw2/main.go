@@ -27,6 +27,7 @@ func main() {
 	log.Logger = log.Output(
 		zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339Nano},
 	)
+	shelly.SetDefaultLogger(log.Logger)
 
 	mqttOpts := MQTT.NewClientOptions()
 	mqttOpts.AddBroker(broker)
@@ -34,7 +35,9 @@ func main() {
 	mqttOpts.SetPassword(password)
 
 	dw2 := shelly.NewShellyDW2("C92B94", mqttOpts)
-	dw2.Connect()
+	if err := dw2.Connect(); err != nil {
+		log.Fatal().Err(err).Msg("Error connecting!")
+	}
 	defer dw2.Close()
 
 	dw2.SubscribeInfo(infoCallback)
@@ -21,6 +21,7 @@ func main() {
 	log.Logger = log.Output(
 		zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339Nano},
 	)
+	shelly.SetDefaultLogger(log.Logger)
 
 	mqttOpts := MQTT.NewClientOptions()
 	mqttOpts.AddBroker(broker)
@@ -28,7 +29,9 @@ func main() {
 	mqttOpts.SetPassword(password)
 
 	plugS := shelly.NewShellyPlugS("EF6948", mqttOpts)
-	plugS.Connect()
+	if err := plugS.Connect(); err != nil {
+		log.Fatal().Err(err).Msg("Error connecting!")
+	}
 	defer plugS.Close()
 
 	plugS.SubscribeRelayState(func() {
@@ -39,10 +42,14 @@ func main() {
 
 	var i = 0
 	for {
+		var err error
 		if i%2 == 0 {
-			plugS.SwitchOn()
+			err = plugS.SwitchOn()
 		} else {
-			plugS.SwitchOff()
+			err = plugS.SwitchOff()
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Error switching relay!")
 		}
 		i++
 
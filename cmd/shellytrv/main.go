@@ -33,6 +33,7 @@ func main() {
 	log.Logger = log.Output(
 		zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339Nano},
 	)
+	shelly.SetDefaultLogger(log.Logger)
 
 	mqttOpts := MQTT.NewClientOptions()
 	mqttOpts.AddBroker(broker)
@@ -40,7 +41,9 @@ func main() {
 	mqttOpts.SetPassword(password)
 
 	trv := shelly.NewShellyTRV("60A423DAE8DE", mqttOpts)
-	trv.Connect()
+	if err := trv.Connect(); err != nil {
+		log.Fatal().Err(err).Msg("Error connecting!")
+	}
 	defer trv.Close()
 
 	trv.SubscribeAll()
@@ -0,0 +1,92 @@
+package shelly
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Codec decodes MQTT payloads into values of type T. Implement it to decode
+// topics this package does not know about and pass it to SubscribeHelper.
+type Codec[T any] interface {
+	Decode(payload []byte) (T, error)
+}
+
+// CodecFunc adapts a plain function to the Codec interface.
+type CodecFunc[T any] func(payload []byte) (T, error)
+
+func (f CodecFunc[T]) Decode(payload []byte) (T, error) {
+	return f(payload)
+}
+
+// JSONCodec decodes JSON payloads into T.
+func JSONCodec[T any]() Codec[T] {
+	return CodecFunc[T](func(payload []byte) (T, error) {
+		var out T
+		err := json.Unmarshal(payload, &out)
+		return out, err
+	})
+}
+
+var (
+	// StringCodec passes the payload through unchanged.
+	StringCodec Codec[string] = CodecFunc[string](func(payload []byte) (string, error) {
+		return string(payload), nil
+	})
+
+	// Float32Codec decodes plain numbers such as "12.34".
+	Float32Codec Codec[float32] = CodecFunc[float32](func(payload []byte) (float32, error) {
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 32)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q is not a number", ErrInvalidPayload, payload)
+		}
+		return float32(value), nil
+	})
+
+	// Float64Codec decodes plain numbers such as "12.34" where float32 is
+	// not precise enough, e.g. counters that keep growing.
+	Float64Codec Codec[float64] = CodecFunc[float64](func(payload []byte) (float64, error) {
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q is not a number", ErrInvalidPayload, payload)
+		}
+		return value, nil
+	})
+
+	// IntCodec decodes plain integers such as "42".
+	IntCodec Codec[int] = CodecFunc[int](func(payload []byte) (int, error) {
+		value, err := strconv.Atoi(strings.TrimSpace(string(payload)))
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q is not an integer", ErrInvalidPayload, payload)
+		}
+		return value, nil
+	})
+
+	// BoolCodec decodes "true" and "false".
+	BoolCodec Codec[bool] = CodecFunc[bool](func(payload []byte) (bool, error) {
+		value, err := strconv.ParseBool(strings.TrimSpace(string(payload)))
+		if err != nil {
+			return false, fmt.Errorf("%w: %q is not a bool", ErrInvalidPayload, payload)
+		}
+		return value, nil
+	})
+
+	// OnOffCodec decodes "on" as true and "off" as false.
+	OnOffCodec Codec[bool] = EnumCodec(map[string]bool{"on": true, "off": false})
+
+	// OpenCloseCodec decodes "open" as true and "close" as false.
+	OpenCloseCodec Codec[bool] = EnumCodec(map[string]bool{"open": true, "close": false})
+)
+
+// EnumCodec decodes payloads by looking them up in values. Any other payload
+// is an error.
+func EnumCodec[T any](values map[string]T) Codec[T] {
+	return CodecFunc[T](func(payload []byte) (T, error) {
+		value, ok := values[string(payload)]
+		if !ok {
+			return value, fmt.Errorf("%w: unexpected value %q", ErrInvalidPayload, payload)
+		}
+		return value, nil
+	})
+}
@@ -0,0 +1,63 @@
+package shelly
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		decode  func([]byte) (interface{}, error)
+		payload string
+		want    interface{}
+		wantErr bool
+	}{
+		{"float", wrap(Float32Codec), "12.5", float32(12.5), false},
+		{"float garbage", wrap(Float32Codec), "twelve", nil, true},
+		{"float64", wrap(Float64Codec), "123456789.5", 123456789.5, false},
+		{"float64 garbage", wrap(Float64Codec), "twelve", nil, true},
+		{"int", wrap(IntCodec), "42", 42, false},
+		{"bool", wrap(BoolCodec), "true", true, false},
+		{"bool garbage", wrap(BoolCodec), "yes please", nil, true},
+		{"on", wrap(OnOffCodec), "on", true, false},
+		{"off", wrap(OnOffCodec), "off", false, false},
+		{"on/off garbage", wrap(OnOffCodec), "overpower", nil, true},
+		{"open", wrap(OpenCloseCodec), "open", true, false},
+		{"close", wrap(OpenCloseCodec), "close", false, false},
+		{"string", wrap(StringCodec), "announce", "announce", false},
+		{"json", wrap(JSONCodec[ShellyButton1InputEvent]()), `{"event":"S","event_cnt":3}`,
+			ShellyButton1InputEvent{Event: "S", EventCnt: 3}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.decode([]byte(tt.payload))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnumCodecError(t *testing.T) {
+	_, err := OnOffCodec.Decode([]byte("maybe"))
+	if !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("got %v, want ErrInvalidPayload", err)
+	}
+}
+
+func wrap[T any](codec Codec[T]) func([]byte) (interface{}, error) {
+	return func(payload []byte) (interface{}, error) {
+		return codec.Decode(payload)
+	}
+}
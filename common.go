@@ -1,10 +1,13 @@
 package shelly
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"math"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 )
 
 type ShellyInfoBat struct {
@@ -12,9 +15,13 @@ type ShellyInfoBat struct {
 	Voltage float32 `json:"voltage"`
 }
 
+// ShellyInfoTmp is a temperature in Units. Devices that report both scales
+// also set TC and TF.
 type ShellyInfoTmp struct {
 	Value   float32 `json:"value"`
 	Units   string  `json:"units"`
+	TC      float32 `json:"tC"`
+	TF      float32 `json:"tF"`
 	IsValid bool    `json:"is_valid"`
 }
 
@@ -24,24 +31,67 @@ type ShellyInfoLux struct {
 	IsValid      bool    `json:"is_valid"`
 }
 
-func logMessage(message MQTT.Message) {
-	log.Debug().
-		Str("message.Topic", string(message.Topic())).
-		Str("message.Payload", string(message.Payload())).
-		Msg("received message")
+// logMessage logs message at debug level. It does not allocate when debug
+// logging is disabled, as it runs for every message received.
+func logMessage(logger *zerolog.Logger, message MQTT.Message) {
+	if e := logger.Debug(); e.Enabled() {
+		e.Str("message.Topic", message.Topic()).
+			Bytes("message.Payload", message.Payload()).
+			Msg("received message")
+	}
+}
+
+// checkRange returns ErrInvalidArgument if value is NaN or outside [min, max].
+func checkRange(name string, value float32, min float32, max float32) error {
+	if math.IsNaN(float64(value)) || value < min || value > max {
+		return fmt.Errorf("%w: %s %v not in [%v, %v]", ErrInvalidArgument, name, value, min, max)
+	}
+	return nil
+}
+
+// defaultContext bounds the methods that do not take a context by
+// tokenTimeout.
+func defaultContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), tokenTimeout)
+}
+
+// waitErr reports an expired deadline as ErrTimeout.
+func waitErr(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return err
+}
+
+// waitToken waits for token to complete or ctx to be done. An expired
+// deadline is reported as ErrTimeout, a cancellation as ctx.Err().
+func waitToken(ctx context.Context, token MQTT.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return waitErr(ctx.Err())
+	}
 }
 
-func checkedJSONUnmarshal[T ShellyDW2Info | ShellyTRVInfo | ShellyTRVStatus | ShellyButton1InputEvent](
-	message MQTT.Message,
-	out *T,
+func checkedPublish(
+	ctx context.Context,
+	logger *zerolog.Logger,
+	mqttClient MQTT.Client,
+	topic string,
+	qos byte,
+	retained bool,
+	payload interface{},
 ) error {
-	err := json.Unmarshal(message.Payload(), out)
-	if err != nil {
-		log.Error().
-			Str("message.Topic", string(message.Topic())).
-			Str("message.Payload", string(message.Payload())).
+	if !mqttClient.IsConnected() {
+		return ErrNotConnected
+	}
+
+	if err := waitToken(ctx, mqttClient.Publish(topic, qos, retained, payload)); err != nil {
+		logger.Error().
+			Str("topic", topic).
 			Err(err).
-			Msg("Error unmarshalling message!")
+			Msg("Error publishing!")
 		return err
 	}
 
@@ -49,61 +99,151 @@ func checkedJSONUnmarshal[T ShellyDW2Info | ShellyTRVInfo | ShellyTRVStatus | Sh
 }
 
 func checkedSubscribe(
+	ctx context.Context,
+	logger *zerolog.Logger,
 	mqttClient MQTT.Client,
 	topic string,
+	qos byte,
 	callback func(client MQTT.Client, message MQTT.Message),
 ) error {
-	if token := mqttClient.Subscribe(topic, byte(qos), callback); token.Wait() &&
-		token.Error() != nil {
-		log.Error().
+	if !mqttClient.IsConnected() {
+		return ErrNotConnected
+	}
+
+	if err := waitToken(ctx, mqttClient.Subscribe(topic, qos, callback)); err != nil {
+		logger.Error().
 			Str("topic", topic).
-			Err(token.Error()).
+			Err(err).
 			Msg("Error subscribing!")
-		return token.Error()
+		return err
 	}
 
-	log.Info().
+	logger.Info().
 		Str("topic", topic).
 		Msg("Subscribed!")
 
 	return nil
 }
 
-func SubscribeJSONHelper[T ShellyTRVInfo | ShellyTRVStatus | ShellyDW2Info | ShellyButton1InputEvent](
+// subscribeClient subscribes directly on mqttClient, bypassing any
+// ConnectionManager. Unsubscribing drops the broker subscription.
+func subscribeClient(
+	ctx context.Context,
+	logger *zerolog.Logger,
 	mqttClient MQTT.Client,
 	topic string,
+	handler MQTT.MessageHandler,
+) (*Subscription, error) {
+	if err := checkedSubscribe(ctx, logger, mqttClient, topic, defaultQoS, handler); err != nil {
+		return nil, err
+	}
+	return newSubscription(func(ctx context.Context) error {
+		return checkedUnsubscribe(ctx, logger, mqttClient, topic)
+	}), nil
+}
+
+// decodingHandler returns a message handler that decodes payloads with codec
+// and passes them to callback. Payloads that fail to decode are logged and
+// dropped.
+func decodingHandler[T any](
+	logger *zerolog.Logger,
+	codec Codec[T],
 	callback func(T),
-) error {
-	cb := func(client MQTT.Client, message MQTT.Message) {
-		logMessage(message)
-		var out T
-		err := checkedJSONUnmarshal(message, &out)
+) MQTT.MessageHandler {
+	return func(client MQTT.Client, message MQTT.Message) {
+		logMessage(logger, message)
+		out, err := codec.Decode(message.Payload())
 		if err != nil {
+			logger.Error().
+				Str("message.Topic", message.Topic()).
+				Bytes("message.Payload", message.Payload()).
+				Err(err).
+				Msg("Error decoding message!")
 			return
 		}
 		callback(out)
 	}
+}
 
-	err := checkedSubscribe(mqttClient, topic, cb)
-	if err != nil {
-		return err
-	}
-	return nil
+// jsonHandler returns a message handler that decodes JSON payloads and
+// passes them to callback.
+func jsonHandler[T any](logger *zerolog.Logger, callback func(T)) MQTT.MessageHandler {
+	return decodingHandler(logger, JSONCodec[T](), callback)
+}
+
+// stringHandler returns a message handler that passes the raw payload to
+// callback.
+func stringHandler(logger *zerolog.Logger, callback func(string)) MQTT.MessageHandler {
+	return decodingHandler(logger, StringCodec, callback)
+}
+
+// SubscribeHelper subscribes to topic and passes every payload decoded with
+// codec to callback.
+func SubscribeHelper[T any](
+	mqttClient MQTT.Client,
+	topic string,
+	codec Codec[T],
+	callback func(T),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return SubscribeHelperCtx(ctx, mqttClient, topic, codec, callback)
+}
+
+// SubscribeHelperCtx is like SubscribeHelper, but ctx bounds the wait for the
+// broker to acknowledge the subscription.
+func SubscribeHelperCtx[T any](
+	ctx context.Context,
+	mqttClient MQTT.Client,
+	topic string,
+	codec Codec[T],
+	callback func(T),
+) (*Subscription, error) {
+	logger := loadDefaultLogger()
+	return subscribeClient(ctx, logger, mqttClient, topic, decodingHandler(logger, codec, callback))
+}
+
+func SubscribeJSONHelper[T any](
+	mqttClient MQTT.Client,
+	topic string,
+	callback func(T),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return SubscribeJSONHelperCtx(ctx, mqttClient, topic, callback)
+}
+
+// SubscribeJSONHelperCtx is like SubscribeJSONHelper, but ctx bounds the wait
+// for the broker to acknowledge the subscription. Cancelling ctx afterwards
+// does not end the subscription.
+func SubscribeJSONHelperCtx[T any](
+	ctx context.Context,
+	mqttClient MQTT.Client,
+	topic string,
+	callback func(T),
+) (*Subscription, error) {
+	logger := loadDefaultLogger()
+	return subscribeClient(ctx, logger, mqttClient, topic, jsonHandler(logger, callback))
 }
 
 func SubscribeStringHelper(
 	mqttClient MQTT.Client,
 	topic string,
 	callback func(string),
-) error {
-	cb := func(client MQTT.Client, message MQTT.Message) {
-		logMessage(message)
-		callback(string(message.Payload()))
-	}
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return SubscribeStringHelperCtx(ctx, mqttClient, topic, callback)
+}
 
-	err := checkedSubscribe(mqttClient, topic, cb)
-	if err != nil {
-		return err
-	}
-	return nil
+// SubscribeStringHelperCtx is like SubscribeStringHelper, but ctx bounds the
+// wait for the broker to acknowledge the subscription.
+func SubscribeStringHelperCtx(
+	ctx context.Context,
+	mqttClient MQTT.Client,
+	topic string,
+	callback func(string),
+) (*Subscription, error) {
+	logger := loadDefaultLogger()
+	return subscribeClient(ctx, logger, mqttClient, topic, stringHandler(logger, callback))
 }
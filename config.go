@@ -1,6 +1,13 @@
 package shelly
 
+import "time"
+
 const (
-	disconnectQiesceTimeMs = 250
-	qos                    = 0
+	defaultQuiesce      = 250 * time.Millisecond
+	defaultQoS          = 0
+	defaultTopicPrefix  = "shellies"
+	tokenTimeout        = 10 * time.Second
+	confirmTimeout      = 30 * time.Second
+	defaultStreamBuffer = 16
+	dispatchQueueSize   = 256
 )
@@ -0,0 +1,51 @@
+package shelly
+
+import (
+	"context"
+	"fmt"
+)
+
+// NotConfirmedError is returned by the confirmed command variants when the
+// device did not report the requested state before the context was done.
+// It matches ErrNotConfirmed with errors.Is and unwraps to the reason the
+// wait ended, usually ErrTimeout.
+type NotConfirmedError struct {
+	DeviceName string
+	Field      string
+	Want       interface{}
+	// Got is the last value the device reported after the command, or nil if
+	// it did not report at all.
+	Got interface{}
+	Err error
+}
+
+func (e *NotConfirmedError) Error() string {
+	if e.Got == nil {
+		return fmt.Sprintf(
+			"%s: %s not confirmed, want %v, got no report: %v", e.DeviceName, e.Field, e.Want, e.Err,
+		)
+	}
+	return fmt.Sprintf(
+		"%s: %s not confirmed, want %v, got %v: %v", e.DeviceName, e.Field, e.Want, e.Got, e.Err,
+	)
+}
+
+func (e *NotConfirmedError) Is(target error) bool {
+	return target == ErrNotConfirmed
+}
+
+func (e *NotConfirmedError) Unwrap() error {
+	return e.Err
+}
+
+// confirmContext bounds the confirmed methods that do not take a context by
+// confirmTimeout.
+func confirmContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), confirmTimeout)
+}
+
+// approxEqual compares reported values, which the devices round.
+func approxEqual(a float32, b float32, tolerance float32) bool {
+	d := a - b
+	return d <= tolerance && d >= -tolerance
+}
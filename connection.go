@@ -0,0 +1,549 @@
+package shelly
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+)
+
+// ConnectionManager owns a single MQTT client and hands out devices bound
+// to it, so any number of devices can share one broker session.
+//
+// Connect and Close are reference counted: the client connects on the first
+// Connect and disconnects once every Connect has been matched by a Close.
+//
+// Subscriptions made by the devices are replayed whenever the client
+// (re)connects, so callbacks keep firing after a broker outage even with a
+// clean session.
+//
+// Incoming messages are matched against the topic filters of every device by
+// a single router. By default each filter is also subscribed at the broker;
+// with WithWildcardSubscription the manager subscribes to shellies/# (or the
+// custom prefix of a device) once instead, which suits fleets of many devices.
+type ConnectionManager struct {
+	mqttOpts   *MQTT.ClientOptions
+	mqttClient MQTT.Client
+	newClient  ClientFactory
+	wildcard   bool
+	quiesce    time.Duration
+	logger     *zerolog.Logger
+
+	router    router
+	topicsMu  sync.Mutex
+	topicRefs map[string]*topicRef
+
+	mu   sync.Mutex
+	refs int
+	// connecting is closed once the connect in progress, if any, is done.
+	connecting chan struct{}
+	devices    []Device
+	bases      []*ShellyDevice
+
+	dispatcher    *dispatcher
+	subscriptions *subscriptionSet
+
+	hooksMu               sync.Mutex
+	onConnectedHooks      []func()
+	onConnectionLostHooks []func(err error)
+	onReconnectingHooks   []func()
+	onCallbackPanicHooks  []PanicHandler
+	userOnConnect         MQTT.OnConnectHandler
+	userOnConnectionLost  MQTT.ConnectionLostHandler
+	userOnReconnecting    MQTT.ReconnectHandler
+}
+
+// topicRef counts the users of a broker subscription.
+type topicRef struct {
+	refs int
+	qos  byte
+	// pending is closed once the broker answered the subscribe in progress,
+	// if any.
+	pending chan struct{}
+}
+
+// ConnectionOption configures a ConnectionManager.
+type ConnectionOption func(*ConnectionManager)
+
+// ClientFactory creates the MQTT client of a ConnectionManager. MQTT.NewClient
+// is the default.
+type ClientFactory func(opts *MQTT.ClientOptions) MQTT.Client
+
+// WithClientFactory replaces MQTT.NewClient, e.g. with the in-process broker
+// of the shellytest package.
+func WithClientFactory(factory ClientFactory) ConnectionOption {
+	return func(c *ConnectionManager) {
+		c.newClient = factory
+	}
+}
+
+// WithWildcardSubscription makes the manager subscribe to shellies/# once
+// instead of subscribing to every topic a device needs. The broker then sends
+// the traffic of all Shelly devices, and messages without a listener are
+// discarded by the router. Devices with a custom topic prefix get one
+// wildcard subscription per prefix.
+func WithWildcardSubscription() ConnectionOption {
+	return func(c *ConnectionManager) {
+		c.wildcard = true
+	}
+}
+
+// WithDisconnectQuiesce sets how long Close waits for pending work before
+// disconnecting from the broker.
+func WithDisconnectQuiesce(quiesce time.Duration) ConnectionOption {
+	return func(c *ConnectionManager) {
+		c.quiesce = quiesce
+	}
+}
+
+func NewConnectionManager(
+	mqttOpts *MQTT.ClientOptions,
+	options ...ConnectionOption,
+) *ConnectionManager {
+	// Work on a copy so that handlers installed here do not leak into other
+	// clients created from the same options.
+	opts := *mqttOpts
+	c := &ConnectionManager{
+		mqttOpts:             &opts,
+		newClient:            MQTT.NewClient,
+		logger:               loadDefaultLogger(),
+		quiesce:              defaultQuiesce,
+		topicRefs:            map[string]*topicRef{},
+		userOnConnect:        mqttOpts.OnConnect,
+		userOnConnectionLost: mqttOpts.OnConnectionLost,
+		userOnReconnecting:   mqttOpts.OnReconnecting,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	c.dispatcher = newDispatcher(
+		c.logger, dispatchQueueSize, func(topic string, recovered interface{}) {
+			c.reportPanic("", topic, recovered)
+		},
+	)
+	c.subscriptions = newSubscriptionSet(c, c.dispatcher, "", defaultQoS)
+	opts.SetOnConnectHandler(c.onConnect)
+	opts.SetConnectionLostHandler(c.onConnectionLost)
+	opts.SetReconnectingHandler(c.onReconnecting)
+	c.mqttClient = c.newClient(&opts)
+	return c
+}
+
+func (c *ConnectionManager) Client() MQTT.Client {
+	return c.mqttClient
+}
+
+func (c *ConnectionManager) Connect() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return c.ConnectCtx(ctx)
+}
+
+// ConnectCtx is like Connect, but gives up waiting for the broker once ctx is
+// done.
+func (c *ConnectionManager) ConnectCtx(ctx context.Context) error {
+	c.mu.Lock()
+	// Wait for a connect in progress. If it fails, try again.
+	for c.connecting != nil {
+		connecting := c.connecting
+		c.mu.Unlock()
+		select {
+		case <-connecting:
+		case <-ctx.Done():
+			return fmt.Errorf("connecting to MQTT broker: %w", waitErr(ctx.Err()))
+		}
+		c.mu.Lock()
+	}
+	if c.refs > 0 {
+		c.refs++
+		c.mu.Unlock()
+		return nil
+	}
+	connecting := make(chan struct{})
+	c.connecting = connecting
+	c.mu.Unlock()
+
+	// Wait without holding mu, which Devices and the like need.
+	err := waitToken(ctx, c.mqttClient.Connect())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connecting = nil
+	close(connecting)
+	if err != nil {
+		c.logger.Error().
+			Err(err).
+			Msg("Error connecting to MQTT!")
+		return fmt.Errorf("connecting to MQTT broker: %w", err)
+	}
+
+	c.refs++
+	return nil
+}
+
+func (c *ConnectionManager) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refs == 0 {
+		return
+	}
+	c.refs--
+	if c.refs > 0 {
+		return
+	}
+
+	c.mqttClient.Disconnect(uint(c.quiesce.Milliseconds()))
+}
+
+// OnConnected registers a hook that runs every time the client has
+// connected, including reconnects.
+func (c *ConnectionManager) OnConnected(hook func()) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onConnectedHooks = append(c.onConnectedHooks, hook)
+}
+
+// OnConnectionLost registers a hook that runs when the connection to the
+// broker drops unexpectedly.
+func (c *ConnectionManager) OnConnectionLost(hook func(err error)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onConnectionLostHooks = append(c.onConnectionLostHooks, hook)
+}
+
+// OnReconnecting registers a hook that runs before every reconnect attempt.
+// It is called from paho's reconnect loop and must not block.
+func (c *ConnectionManager) OnReconnecting(hook func()) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onReconnectingHooks = append(c.onReconnectingHooks, hook)
+}
+
+// OnCallbackPanic registers a hook that runs when a subscription callback
+// panics. The panic is recovered and delivery continues with the next
+// message. deviceName is empty for callbacks not tied to a device.
+func (c *ConnectionManager) OnCallbackPanic(hook PanicHandler) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onCallbackPanicHooks = append(c.onCallbackPanicHooks, hook)
+}
+
+func (c *ConnectionManager) reportPanic(deviceName string, topic string, recovered interface{}) {
+	c.hooksMu.Lock()
+	hooks := append([]PanicHandler{}, c.onCallbackPanicHooks...)
+	c.hooksMu.Unlock()
+	for _, hook := range hooks {
+		hook(deviceName, topic, recovered)
+	}
+}
+
+// DispatchMetrics reports on the dispatch queue of every device, keyed by
+// device name. Callbacks not tied to a device are reported under "".
+func (c *ConnectionManager) DispatchMetrics() map[string]DispatchMetrics {
+	c.mu.Lock()
+	bases := append([]*ShellyDevice{}, c.bases...)
+	c.mu.Unlock()
+
+	metrics := map[string]DispatchMetrics{"": c.dispatcher.metrics()}
+	for _, base := range bases {
+		metrics[base.DeviceName()] = base.DispatchMetrics()
+	}
+	return metrics
+}
+
+func (c *ConnectionManager) onConnect(client MQTT.Client) {
+	c.logger.Info().Msg("connected to MQTT broker")
+
+	// Subscribing waits for the broker, so do it off paho's goroutine.
+	go c.resubscribe()
+
+	c.hooksMu.Lock()
+	hooks := append([]func(){}, c.onConnectedHooks...)
+	c.hooksMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	if c.userOnConnect != nil {
+		c.userOnConnect(client)
+	}
+}
+
+func (c *ConnectionManager) onConnectionLost(client MQTT.Client, err error) {
+	c.logger.Error().Err(err).Msg("lost connection to MQTT broker")
+
+	c.hooksMu.Lock()
+	hooks := append([]func(error){}, c.onConnectionLostHooks...)
+	c.hooksMu.Unlock()
+	for _, hook := range hooks {
+		hook(err)
+	}
+
+	if c.userOnConnectionLost != nil {
+		c.userOnConnectionLost(client, err)
+	}
+}
+
+func (c *ConnectionManager) onReconnecting(client MQTT.Client, opts *MQTT.ClientOptions) {
+	c.logger.Info().Msg("reconnecting to MQTT broker")
+
+	c.hooksMu.Lock()
+	hooks := append([]func(){}, c.onReconnectingHooks...)
+	c.hooksMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	if c.userOnReconnecting != nil {
+		c.userOnReconnecting(client, opts)
+	}
+}
+
+func (c *ConnectionManager) Subscribe(
+	filter string,
+	handler MQTT.MessageHandler,
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return c.SubscribeCtx(ctx, filter, handler)
+}
+
+// SubscribeCtx calls handler for every message matching filter, which need
+// not belong to a single device. Like the subscriptions of devices, it is
+// renewed after a reconnect and shares broker subscriptions with them.
+func (c *ConnectionManager) SubscribeCtx(
+	ctx context.Context,
+	filter string,
+	handler MQTT.MessageHandler,
+) (*Subscription, error) {
+	return c.subscriptions.subscribe(ctx, filter, handler)
+}
+
+// acquire makes sure the broker sends messages matching filter with at
+// least the given QoS. The first acquire of a filter subscribes at the
+// broker; in wildcard mode all filters below the same topic prefix share one
+// subscription.
+func (c *ConnectionManager) acquire(
+	ctx context.Context,
+	filter string,
+	topicPrefix string,
+	qos byte,
+) error {
+	if !c.mqttClient.IsConnected() {
+		return ErrNotConnected
+	}
+
+	brokerFilter := c.brokerFilter(filter, topicPrefix)
+	c.topicsMu.Lock()
+	ref, ok := c.topicRefs[brokerFilter]
+	// Only count on a subscription the broker confirmed. If the subscribe in
+	// progress fails, the ref is gone and the next round tries again.
+	for ok && ref.pending != nil {
+		pending := ref.pending
+		c.topicsMu.Unlock()
+		select {
+		case <-pending:
+		case <-ctx.Done():
+			return waitErr(ctx.Err())
+		}
+		c.topicsMu.Lock()
+		ref, ok = c.topicRefs[brokerFilter]
+	}
+	if !ok {
+		ref = &topicRef{}
+		c.topicRefs[brokerFilter] = ref
+	}
+	ref.refs++
+	previousQoS := ref.qos
+	if ok && ref.qos >= qos {
+		c.topicsMu.Unlock()
+		return nil
+	}
+	ref.qos = qos
+	pending := make(chan struct{})
+	ref.pending = pending
+	c.topicsMu.Unlock()
+
+	err := c.subscribeBroker(ctx, brokerFilter, qos)
+
+	c.topicsMu.Lock()
+	ref.pending = nil
+	close(pending)
+	if err == nil {
+		c.topicsMu.Unlock()
+		return nil
+	}
+	// Later acquires must not skip an upgrade that was never granted.
+	ref.qos = previousQoS
+	last := c.dropTopicRef(brokerFilter)
+	c.topicsMu.Unlock()
+	if ok && last {
+		// The other users released the subscription while it was being
+		// upgraded, leaving it to this acquire to end it.
+		checkedUnsubscribe(ctx, c.logger, c.mqttClient, brokerFilter)
+	}
+	return err
+}
+
+// release undoes an acquire, unsubscribing at the broker once filter is no
+// longer needed.
+func (c *ConnectionManager) release(
+	ctx context.Context,
+	filter string,
+	topicPrefix string,
+) error {
+	brokerFilter := c.brokerFilter(filter, topicPrefix)
+	c.topicsMu.Lock()
+	last := c.dropTopicRef(brokerFilter)
+	c.topicsMu.Unlock()
+	if !last {
+		return nil
+	}
+	return checkedUnsubscribe(ctx, c.logger, c.mqttClient, brokerFilter)
+}
+
+// dropTopicRef decrements the reference count of a broker filter and reports
+// whether it reached zero. topicsMu must be held.
+func (c *ConnectionManager) dropTopicRef(brokerFilter string) bool {
+	ref, ok := c.topicRefs[brokerFilter]
+	if !ok {
+		return false
+	}
+	ref.refs--
+	if ref.refs > 0 {
+		return false
+	}
+	delete(c.topicRefs, brokerFilter)
+	return true
+}
+
+// brokerFilter returns the broker subscription serving filter. In wildcard
+// mode that is topicPrefix/# for filters below topicPrefix and otherwise the
+// first level of filter followed by /#.
+func (c *ConnectionManager) brokerFilter(filter string, topicPrefix string) string {
+	if !c.wildcard {
+		return filter
+	}
+	if topicPrefix != "" && strings.HasPrefix(filter, topicPrefix+"/") {
+		return topicPrefix + "/#"
+	}
+	prefix, _, _ := strings.Cut(filter, "/")
+	return prefix + "/#"
+}
+
+func (c *ConnectionManager) subscribeBroker(
+	ctx context.Context,
+	brokerFilter string,
+	qos byte,
+) error {
+	handler := c.routeHandler(brokerFilter)
+	if c.wildcard {
+		handler = c.routeHandler("")
+	}
+	return checkedSubscribe(ctx, c.logger, c.mqttClient, brokerFilter, qos, handler)
+}
+
+// routeHandler returns the broker-level handler of a subscription. Paho calls
+// the handler of every subscription matching a message, so in per-topic mode
+// each handler only serves the routes of its own filter; otherwise a message
+// matching both shellies/x/# and shellies/x/online would be delivered twice.
+func (c *ConnectionManager) routeHandler(filter string) MQTT.MessageHandler {
+	return func(client MQTT.Client, message MQTT.Message) {
+		c.route(client, message, filter)
+	}
+}
+
+// route passes message to every subscriptionSet with a matching filter, or
+// only to those subscribed to filter if it is not empty.
+func (c *ConnectionManager) route(client MQTT.Client, message MQTT.Message, filter string) {
+	// Enough for any realistic number of overlapping filters; match only
+	// allocates beyond that.
+	var buf [8]*routeEntry
+	for _, entry := range c.router.match(message.Topic(), buf[:0]) {
+		if filter == "" || entry.filter == filter {
+			entry.set.deliver(entry, client, message)
+		}
+	}
+}
+
+// resubscribe replays the broker subscriptions after a reconnect.
+func (c *ConnectionManager) resubscribe() {
+	c.topicsMu.Lock()
+	refs := make(map[string]byte, len(c.topicRefs))
+	for brokerFilter, ref := range c.topicRefs {
+		refs[brokerFilter] = ref.qos
+	}
+	c.topicsMu.Unlock()
+
+	for brokerFilter, qos := range refs {
+		ctx, cancel := defaultContext()
+		err := c.subscribeBroker(ctx, brokerFilter, qos)
+		cancel()
+		if err != nil {
+			c.logger.Error().Err(err).Msg("Error resubscribing!")
+		}
+	}
+}
+
+// Devices returns every device handed out by this manager.
+func (c *ConnectionManager) Devices() []Device {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	devices := make([]Device, len(c.devices))
+	copy(devices, c.devices)
+	return devices
+}
+
+func (c *ConnectionManager) addDevice(device Device, base *ShellyDevice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.devices = append(c.devices, device)
+	c.bases = append(c.bases, base)
+}
+
+func (c *ConnectionManager) NewShellyTRV(deviceId string, opts ...DeviceOption) ShellyTRV {
+	s := ShellyTRV{
+		ShellyDevice: newShellyDevice(c, shellyTRVDeviceType, deviceId, opts),
+		state:        &shadow[ShellyTRVState]{},
+	}
+	c.addDevice(s, s.ShellyDevice)
+	s.logger.Debug().Msg("New ShellyTRV")
+	return s
+}
+
+func (c *ConnectionManager) NewShellyPlugS(deviceId string, opts ...DeviceOption) ShellyPlugS {
+	s := ShellyPlugS{
+		ShellyDevice: newShellyDevice(c, shellyPlugSDeviceType, deviceId, opts),
+		state:        &shadow[ShellyPlugSState]{},
+	}
+	c.addDevice(s, s.ShellyDevice)
+	s.logger.Debug().Msg("New ShellyPlugS")
+	return s
+}
+
+func (c *ConnectionManager) NewShellyDW2(deviceId string, opts ...DeviceOption) ShellyDW2 {
+	s := ShellyDW2{
+		ShellyDevice: newShellyDevice(c, shellyDW2DeviceType, deviceId, opts),
+		state:        &shadow[ShellyDW2State]{},
+	}
+	c.addDevice(s, s.ShellyDevice)
+	s.logger.Debug().Msg("New ShellyDW2")
+	return s
+}
+
+func (c *ConnectionManager) NewShellyButton1(deviceId string, opts ...DeviceOption) ShellyButton1 {
+	s := ShellyButton1{
+		ShellyDevice: newShellyDevice(c, shellyButton1DeviceType, deviceId, opts),
+		state:        &shadow[ShellyButton1State]{},
+	}
+	c.addDevice(s, s.ShellyDevice)
+	s.logger.Debug().Msg("New ShellyButton1")
+	return s
+}
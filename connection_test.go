@@ -0,0 +1,379 @@
+package shelly
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/washed/shelly-go/shellytest"
+)
+
+// newTestConnection returns a connected ConnectionManager backed by an
+// in-process broker.
+func newTestConnection(
+	t *testing.T,
+	opts ...ConnectionOption,
+) (*ConnectionManager, *shellytest.Broker) {
+	t.Helper()
+	broker := shellytest.NewBroker()
+	opts = append(opts, WithClientFactory(broker.NewClient))
+	conn := NewConnectionManager(MQTT.NewClientOptions(), opts...)
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	return conn, broker
+}
+
+// testContext bounds waits for asynchronous delivery in tests.
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a callback")
+		panic("unreachable")
+	}
+}
+
+func waitSubscribed(t *testing.T, broker *shellytest.Broker, filter string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !broker.Subscribed(filter) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not subscribed", filter)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectionBrokerSubscriptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []ConnectionOption
+		filters []string
+	}{
+		{"per topic", nil, []string{"shellies/shellyplug-s-EF6948/relay/0/power"}},
+		{"wildcard", []ConnectionOption{WithWildcardSubscription()}, []string{"shellies/#"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, broker := newTestConnection(t, test.opts...)
+			plugS := conn.NewShellyPlugS("EF6948")
+
+			powers := make(chan float32, 4)
+			first, err := plugS.SubscribePower(func(power float32) { powers <- power })
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := plugS.SubscribePower(func(power float32) { powers <- power })
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, filter := range test.filters {
+				if !broker.Subscribed(filter) {
+					t.Errorf("%s not subscribed", filter)
+				}
+			}
+
+			broker.Publish("shellies/shellyplug-s-EF6948/relay/0/power", "12.5")
+			for i := 0; i < 2; i++ {
+				if got := receive(t, powers); got != 12.5 {
+					t.Errorf("got power %v, want 12.5", got)
+				}
+			}
+
+			if err := first.Unsubscribe(); err != nil {
+				t.Fatal(err)
+			}
+			if !broker.Subscribed(test.filters[0]) {
+				t.Error("unsubscribed while a listener remains")
+			}
+			if err := second.Unsubscribe(); err != nil {
+				t.Fatal(err)
+			}
+			if broker.Subscribed(test.filters[0]) {
+				t.Error("still subscribed without listeners")
+			}
+		})
+	}
+}
+
+func TestConnectionWildcardTopicPrefix(t *testing.T) {
+	conn, broker := newTestConnection(t, WithWildcardSubscription())
+	plugS := conn.NewShellyPlugS("EF6948", WithTopicPrefix("home/shellies"))
+
+	powers := make(chan float32, 1)
+	if _, err := plugS.SubscribePower(func(power float32) { powers <- power }); err != nil {
+		t.Fatal(err)
+	}
+	// The registry shares the subscription of the devices with its prefix.
+	registry := conn.NewRegistry(WithRegistryTopicPrefix("home/shellies"))
+	if err := registry.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	if !broker.Subscribed("home/shellies/#") || broker.Subscribed("home/#") {
+		t.Error("want a single subscription to home/shellies/#")
+	}
+
+	broker.Publish("home/shellies/shellyplug-s-EF6948/relay/0/power", "12.5")
+	if got := receive(t, powers); got != 12.5 {
+		t.Errorf("got power %v, want 12.5", got)
+	}
+}
+
+func TestConnectionResubscribes(t *testing.T) {
+	for _, wildcard := range []bool{false, true} {
+		var opts []ConnectionOption
+		filter := "shellies/shellydw2-C92B94/sensor/state"
+		if wildcard {
+			opts = append(opts, WithWildcardSubscription())
+			filter = "shellies/#"
+		}
+
+		conn, broker := newTestConnection(t, opts...)
+		dw2 := conn.NewShellyDW2("C92B94")
+		opened := make(chan bool, 1)
+		if _, err := dw2.SubscribeOpenState(func() { opened <- true }, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		broker.DropConnections()
+		if broker.Subscribed(filter) {
+			t.Fatal("subscription survived the dropped connection")
+		}
+		broker.Reconnect()
+		waitSubscribed(t, broker, filter)
+
+		broker.Publish("shellies/shellydw2-C92B94/sensor/state", "open")
+		receive(t, opened)
+	}
+}
+
+func TestConnectionSubscribe(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	topics := make(chan string, 4)
+	handler := func(_ MQTT.Client, message MQTT.Message) { topics <- message.Topic() }
+	subscription, err := conn.Subscribe("shellies/+/online", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.DropConnections()
+	broker.Reconnect()
+	waitSubscribed(t, broker, "shellies/+/online")
+	broker.Publish("shellies/shellyplug-s-A1/online", "true")
+	if got := receive(t, topics); got != "shellies/shellyplug-s-A1/online" {
+		t.Errorf("got topic %s", got)
+	}
+
+	if err := subscription.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if broker.Subscribed("shellies/+/online") {
+		t.Error("still subscribed after Unsubscribe")
+	}
+}
+
+// scriptedClient answers subscribes with the tokens of subscribe.
+type scriptedClient struct {
+	MQTT.Client
+	subscribe func(topic string, qos byte) MQTT.Token
+}
+
+func (c scriptedClient) Subscribe(
+	topic string,
+	qos byte,
+	callback MQTT.MessageHandler,
+) MQTT.Token {
+	if token := c.subscribe(topic, qos); token != nil {
+		return token
+	}
+	return c.Client.Subscribe(topic, qos, callback)
+}
+
+// testToken completes once done is closed, with err.
+type testToken struct {
+	done chan struct{}
+	err  error
+}
+
+func (t *testToken) Wait() bool                       { <-t.done; return true }
+func (t *testToken) WaitTimeout(d time.Duration) bool { return true }
+func (t *testToken) Done() <-chan struct{}            { return t.done }
+func (t *testToken) Error() error                     { return t.err }
+
+func newScriptedConnection(
+	t *testing.T,
+	subscribe func(topic string, qos byte) MQTT.Token,
+) *ConnectionManager {
+	t.Helper()
+	broker := shellytest.NewBroker()
+	newClient := func(opts *MQTT.ClientOptions) MQTT.Client {
+		opts.SetOnConnectHandler(nil)
+		return scriptedClient{Client: broker.NewClient(opts), subscribe: subscribe}
+	}
+	conn := NewConnectionManager(MQTT.NewClientOptions(), WithClientFactory(newClient))
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+func TestConnectionAcquireWaitsForBroker(t *testing.T) {
+	const filter = "shellies/x/online"
+	failed := errors.New("not authorized")
+	first := &testToken{done: make(chan struct{}), err: failed}
+	var mu sync.Mutex
+	calls := 0
+	conn := newScriptedConnection(t, func(string, byte) MQTT.Token {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			return first
+		}
+		return nil
+	})
+
+	errs := make(chan error, 2)
+	go func() { errs <- conn.acquire(testContext(t), filter, "", 0) }()
+	for {
+		conn.topicsMu.Lock()
+		ref := conn.topicRefs[filter]
+		conn.topicsMu.Unlock()
+		if ref != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() { errs <- conn.acquire(testContext(t), filter, "", 0) }()
+	select {
+	case err := <-errs:
+		t.Fatalf("acquire returned %v before the broker answered", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The first subscribe fails, so the second acquire subscribes itself.
+	close(first.done)
+	var got []error
+	for i := 0; i < 2; i++ {
+		got = append(got, receive(t, errs))
+	}
+	if !(got[0] == failed && got[1] == nil) && !(got[0] == nil && got[1] == failed) {
+		t.Errorf("got errors %v, want one failure and one success", got)
+	}
+	if ref := conn.topicRefs[filter]; ref == nil || ref.refs != 1 {
+		t.Errorf("got ref %+v, want a single user", ref)
+	}
+}
+
+func TestConnectionAcquireFailedUpgrade(t *testing.T) {
+	const filter = "shellies/x/online"
+	failed := errors.New("qos not granted")
+	var mu sync.Mutex
+	var subscribed []byte
+	fail := true
+	conn := newScriptedConnection(t, func(_ string, qos byte) MQTT.Token {
+		mu.Lock()
+		defer mu.Unlock()
+		subscribed = append(subscribed, qos)
+		if qos == 1 && fail {
+			fail = false
+			done := make(chan struct{})
+			close(done)
+			return &testToken{done: done, err: failed}
+		}
+		return nil
+	})
+
+	if err := conn.acquire(testContext(t), filter, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.acquire(testContext(t), filter, "", 1); err != failed {
+		t.Fatalf("got %v, want %v", err, failed)
+	}
+	if ref := conn.topicRefs[filter]; ref.qos != 0 || ref.refs != 1 {
+		t.Errorf("got ref %+v after the failed upgrade, want QoS 0 and one user", ref)
+	}
+	// The next acquire tries the upgrade again.
+	if err := conn.acquire(testContext(t), filter, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 1, 1}; !bytes.Equal(subscribed, want) {
+		t.Errorf("got subscribes with QoS %v, want %v", subscribed, want)
+	}
+}
+
+// connectingClient answers Connect with connect.
+type connectingClient struct {
+	MQTT.Client
+	connect *testToken
+}
+
+func (c connectingClient) Connect() MQTT.Token {
+	c.Client.Connect().Wait()
+	return c.connect
+}
+
+func TestConnectionConnectDoesNotBlock(t *testing.T) {
+	broker := shellytest.NewBroker()
+	token := &testToken{done: make(chan struct{})}
+	newClient := func(opts *MQTT.ClientOptions) MQTT.Client {
+		return connectingClient{Client: broker.NewClient(opts), connect: token}
+	}
+	conn := NewConnectionManager(MQTT.NewClientOptions(), WithClientFactory(newClient))
+	t.Cleanup(conn.Close)
+
+	errs := make(chan error, 2)
+	go func() { errs <- conn.ConnectCtx(testContext(t)) }()
+	for {
+		conn.mu.Lock()
+		connecting := conn.connecting != nil
+		conn.mu.Unlock()
+		if connecting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() { errs <- conn.ConnectCtx(testContext(t)) }()
+
+	devices := make(chan []Device, 1)
+	go func() { devices <- conn.Devices() }()
+	select {
+	case <-devices:
+	case <-time.After(time.Second):
+		t.Fatal("Devices blocked while connecting")
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("ConnectCtx returned %v before the broker answered", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Both callers share the one connect.
+	close(token.done)
+	for i := 0; i < 2; i++ {
+		if err := receive(t, errs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.refs != 2 {
+		t.Errorf("got %d refs, want 2", conn.refs)
+	}
+}
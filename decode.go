@@ -0,0 +1,141 @@
+package shelly
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TopicInfo describes where a topic belongs: a device's topics are
+// "<prefix>/<type>-<id>/<subtopic>". DeviceType and DeviceId are empty for
+// topics not tied to a device, such as shellies/announce.
+type TopicInfo struct {
+	Prefix     string
+	DeviceType string
+	DeviceId   string
+	Subtopic   string
+}
+
+// DeviceName returns "<type>-<id>", or "" for topics not tied to a device.
+func (t TopicInfo) DeviceName() string {
+	if t.DeviceType == "" {
+		return ""
+	}
+	return t.DeviceType + "-" + t.DeviceId
+}
+
+// DecodedMessage is a message decoded into the type the Subscribe methods
+// of its device pass to their callbacks.
+type DecodedMessage struct {
+	TopicInfo
+	Value interface{}
+}
+
+type payloadDecoder = func(payload []byte) (interface{}, error)
+
+func decodeWith[T any](codec Codec[T]) payloadDecoder {
+	return func(payload []byte) (interface{}, error) {
+		return codec.Decode(payload)
+	}
+}
+
+// topicDecoders maps device types and subtopics to decoders. The entries
+// under "" apply to every device type.
+var topicDecoders = map[string]map[string]payloadDecoder{
+	"": {
+		"online": decodeWith(BoolCodec),
+	},
+	shellyTRVDeviceType: {
+		"status": decodeWith(JSONCodec[ShellyTRVStatus]()),
+		"info":   decodeWith(JSONCodec[ShellyTRVInfo]()),
+	},
+	shellyPlugSDeviceType: {
+		"relay/0":         decodeWith(OnOffCodec),
+		"relay/0/power":   decodeWith(Float32Codec),
+		"relay/0/command": decodeWith(StringCodec),
+		"relay/0/energy":  decodeWith(energyCodec),
+		"temperature":     decodeWith(Float32Codec),
+		"temperature_f":   decodeWith(Float32Codec),
+		"overtemperature": decodeWith(overtemperatureCodec),
+	},
+	shellyDW2DeviceType: {
+		"sensor/state":        decodeWith(OpenCloseCodec),
+		"sensor/tilt":         decodeWith(IntCodec),
+		"sensor/vibration":    decodeWith(vibrationCodec),
+		"sensor/lux":          decodeWith(Float32Codec),
+		"sensor/illumination": decodeWith(StringCodec),
+		"sensor/temperature":  decodeWith(Float32Codec),
+		"sensor/battery":      decodeWith(Float32Codec),
+		"sensor/error":        decodeWith(IntCodec),
+		"info":                decodeWith(JSONCodec[ShellyDW2Info]()),
+	},
+	shellyButton1DeviceType: {
+		"sensor/battery": decodeWith(Float32Codec),
+		"input_event/0":  decodeWith(JSONCodec[ShellyButton1InputEvent]()),
+	},
+}
+
+// DeviceTypeForModel returns the device type used in the topics of a model,
+// e.g. "shellyplug-s" for "SHPLG-S".
+func DeviceTypeForModel(model string) (string, bool) {
+	deviceType, ok := modelDeviceTypes[model]
+	return deviceType, ok
+}
+
+// ParseTopic splits a device topic into its parts. Topics not tied to a
+// device only have Prefix and Subtopic set. It reports false for topics
+// without a known device type that are not below a "shellies" level either.
+func ParseTopic(topic string) (TopicInfo, bool) {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		for deviceType := range topicDecoders {
+			if deviceType == "" || !strings.HasPrefix(level, deviceType+"-") {
+				continue
+			}
+			return TopicInfo{
+				Prefix:     strings.Join(levels[:i], "/"),
+				DeviceType: deviceType,
+				DeviceId:   strings.TrimPrefix(level, deviceType+"-"),
+				Subtopic:   strings.Join(levels[i+1:], "/"),
+			}, true
+		}
+	}
+
+	for i, level := range levels {
+		if level == defaultTopicPrefix && i+1 < len(levels) {
+			return TopicInfo{
+				Prefix:   strings.Join(levels[:i+1], "/"),
+				Subtopic: strings.Join(levels[i+1:], "/"),
+			}, true
+		}
+	}
+	return TopicInfo{}, false
+}
+
+// DecodeMessage decodes a message on one of the topics this package knows.
+// For any other topic it returns what ParseTopic found and ErrUnknownTopic.
+func DecodeMessage(topic string, payload []byte) (DecodedMessage, error) {
+	info, ok := ParseTopic(topic)
+	if !ok {
+		return DecodedMessage{}, fmt.Errorf("%w: %s", ErrUnknownTopic, topic)
+	}
+	decoded := DecodedMessage{TopicInfo: info}
+
+	decode := topicDecoders[info.DeviceType][info.Subtopic]
+	switch {
+	case decode != nil:
+	case info.DeviceType == "" && info.Subtopic == "announce":
+		decode = decodeWith(JSONCodec[ShellyAnnounce]())
+	case info.DeviceType != "":
+		decode = topicDecoders[""][info.Subtopic]
+	}
+	if decode == nil {
+		return decoded, fmt.Errorf("%w: %s", ErrUnknownTopic, topic)
+	}
+
+	value, err := decode(payload)
+	if err != nil {
+		return decoded, err
+	}
+	decoded.Value = value
+	return decoded, nil
+}
@@ -0,0 +1,85 @@
+package shelly
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  TopicInfo
+		ok    bool
+	}{
+		{
+			"shellies/shellyplug-s-EF6948/relay/0/power",
+			TopicInfo{"shellies", "shellyplug-s", "EF6948", "relay/0/power"}, true,
+		},
+		{
+			"home/floor1/shellytrv-60A423D0E032/info",
+			TopicInfo{"home/floor1", "shellytrv", "60A423D0E032", "info"}, true,
+		},
+		{"shellies/announce", TopicInfo{Prefix: "shellies", Subtopic: "announce"}, true},
+		{"other/topic", TopicInfo{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.topic, func(t *testing.T) {
+			got, ok := ParseTopic(test.topic)
+			if got != test.want || ok != test.ok {
+				t.Errorf("got %+v, %v, want %+v, %v", got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		topic   string
+		payload string
+		check   func(value interface{}) bool
+	}{
+		{
+			"shellies/shellyplug-s-EF6948/relay/0/power", "42.25",
+			func(value interface{}) bool { return value == float32(42.25) },
+		},
+		{
+			// Large counters keep every digit, which float32 would round.
+			"shellies/shellyplug-s-EF6948/relay/0/energy", "600000006",
+			func(value interface{}) bool { return value == 10000000.1 },
+		},
+		{
+			"shellies/shellydw2-C92B94/online", "true",
+			func(value interface{}) bool { return value == true },
+		},
+		{
+			"shellies/shellydw2-C92B94/info", `{"accel": {"tilt": 8}}`,
+			func(value interface{}) bool { return value.(ShellyDW2Info).Accel.Tilt == 8 },
+		},
+		{
+			"shellies/announce", `{"id": "shellyplug-s-EF6948", "model": "SHPLG-S"}`,
+			func(value interface{}) bool { return value.(ShellyAnnounce).Model == "SHPLG-S" },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.topic, func(t *testing.T) {
+			got, err := DecodeMessage(test.topic, []byte(test.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(got.Value) {
+				t.Errorf("unexpected value %#v", got.Value)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	_, err := DecodeMessage("shellies/shellytrv-1/unknown", nil)
+	if !errors.Is(err, ErrUnknownTopic) {
+		t.Errorf("got %v, want ErrUnknownTopic", err)
+	}
+	_, err = DecodeMessage("shellies/shellyplug-s-1/relay/0/power", []byte("x"))
+	if !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("got %v, want ErrInvalidPayload", err)
+	}
+}
@@ -0,0 +1,335 @@
+package shelly
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShellyAnnounce is published by every Gen1 device on shellies/announce when
+// it connects and in reply to an "announce" command.
+type ShellyAnnounce struct {
+	ID    string `json:"id"`
+	Model string `json:"model"`
+	MAC   string `json:"mac"`
+	IP    string `json:"ip"`
+	NewFW bool   `json:"new_fw"`
+	FWVer string `json:"fw_ver"`
+}
+
+// modelDeviceTypes maps the model string of an announcement to the device
+// type prefix used in topics.
+var modelDeviceTypes = map[string]string{
+	"SHTRV-01": shellyTRVDeviceType,
+	"SHPLG-S":  shellyPlugSDeviceType,
+	"SHDW-2":   shellyDW2DeviceType,
+	"SHBTN-1":  shellyButton1DeviceType,
+	"SHBTN-2":  shellyButton1DeviceType,
+}
+
+// DiscoveredDevice is a registry entry built from announcements.
+type DiscoveredDevice struct {
+	ShellyAnnounce
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// DeviceId returns the part of the announced ID after the device type
+// prefix, i.e. the deviceId expected by the device constructors.
+func (d DiscoveredDevice) DeviceId() (string, error) {
+	deviceType, ok := modelDeviceTypes[d.Model]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownModel, d.Model)
+	}
+	deviceId := strings.TrimPrefix(d.ID, deviceType+"-")
+	if deviceId == d.ID {
+		return "", fmt.Errorf(
+			"%w: id %q does not start with %q", ErrInvalidArgument, d.ID, deviceType,
+		)
+	}
+	return deviceId, nil
+}
+
+type RegistryEventType int
+
+const (
+	DeviceAdded RegistryEventType = iota
+	DeviceChanged
+	DeviceRemoved
+)
+
+func (t RegistryEventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "added"
+	case DeviceChanged:
+		return "changed"
+	case DeviceRemoved:
+		return "removed"
+	default:
+		return fmt.Sprintf("RegistryEventType(%d)", int(t))
+	}
+}
+
+type RegistryEvent struct {
+	Type   RegistryEventType
+	Device DiscoveredDevice
+}
+
+type RegistryEventCallback = func(event RegistryEvent)
+
+// Registry tracks the devices announcing themselves on shellies/announce.
+type Registry struct {
+	conn          *ConnectionManager
+	topicPrefix   string
+	subscriptions *subscriptionSet
+
+	// startMu is held while subscribing to announcements, so concurrent
+	// DiscoverCtx calls subscribe once.
+	startMu sync.Mutex
+	started bool
+
+	mu        sync.Mutex
+	devices   map[string]DiscoveredDevice
+	callbacks []RegistryEventCallback
+}
+
+// RegistryOption configures a Registry.
+type RegistryOption func(*Registry)
+
+// WithRegistryTopicPrefix replaces the "shellies" prefix of the announce and
+// command topics, like WithTopicPrefix does for the topics of a device.
+func WithRegistryTopicPrefix(prefix string) RegistryOption {
+	return func(r *Registry) {
+		r.topicPrefix = prefix
+	}
+}
+
+func (c *ConnectionManager) NewRegistry(opts ...RegistryOption) *Registry {
+	r := &Registry{
+		conn:        c,
+		topicPrefix: defaultTopicPrefix,
+		devices:     map[string]DiscoveredDevice{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.subscriptions = newSubscriptionSet(c, c.dispatcher, r.topicPrefix, defaultQoS)
+	return r
+}
+
+func (r *Registry) announceTopic() string {
+	return r.topicPrefix + "/announce"
+}
+
+func (r *Registry) commandTopic() string {
+	return r.topicPrefix + "/command"
+}
+
+// OnEvent registers a callback for added, changed and removed devices.
+func (r *Registry) OnEvent(callback RegistryEventCallback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.callbacks = append(r.callbacks, callback)
+}
+
+func (r *Registry) Discover() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return r.DiscoverCtx(ctx)
+}
+
+// DiscoverCtx subscribes to announcements, if it has not done so yet, and
+// asks every device to announce itself. Replies arrive asynchronously.
+func (r *Registry) DiscoverCtx(ctx context.Context) error {
+	if err := r.start(ctx); err != nil {
+		return err
+	}
+
+	r.conn.logger.Info().Msg("Poking for shelly announce")
+	return r.command(ctx, "announce")
+}
+
+func (r *Registry) RequestUpdate() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return r.RequestUpdateCtx(ctx)
+}
+
+// RequestUpdateCtx asks every device to publish its current state.
+func (r *Registry) RequestUpdateCtx(ctx context.Context) error {
+	r.conn.logger.Info().Msg("Requesting shelly update")
+	return r.command(ctx, "update")
+}
+
+// command publishes a command to every device.
+func (r *Registry) command(ctx context.Context, command string) error {
+	return checkedPublish(
+		ctx, r.conn.logger, r.conn.mqttClient, r.commandTopic(), defaultQoS, false, command,
+	)
+}
+
+// start subscribes to announcements unless that already happened.
+func (r *Registry) start(ctx context.Context) error {
+	r.startMu.Lock()
+	defer r.startMu.Unlock()
+	if r.started {
+		return nil
+	}
+	handler := jsonHandler(r.conn.logger, r.handleAnnounce)
+	_, err := r.subscriptions.subscribe(ctx, r.announceTopic(), handler)
+	if err != nil {
+		return err
+	}
+	r.started = true
+	return nil
+}
+
+func (r *Registry) handleAnnounce(announce ShellyAnnounce) {
+	if announce.ID == "" {
+		r.conn.logger.Error().Interface("announce", announce).Msg("received announce without id")
+		return
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	device, known := r.devices[announce.ID]
+	changed := known && device.ShellyAnnounce != announce
+	if !known {
+		device.FirstSeen = now
+	}
+	device.ShellyAnnounce = announce
+	device.LastSeen = now
+	r.devices[announce.ID] = device
+	r.mu.Unlock()
+
+	switch {
+	case !known:
+		r.emit(RegistryEvent{Type: DeviceAdded, Device: device})
+	case changed:
+		r.emit(RegistryEvent{Type: DeviceChanged, Device: device})
+	}
+}
+
+func (r *Registry) emit(event RegistryEvent) {
+	r.conn.logger.Info().
+		Str("id", event.Device.ID).
+		Str("model", event.Device.Model).
+		Stringer("event", event.Type).
+		Msg("registry event")
+
+	r.mu.Lock()
+	callbacks := append([]RegistryEventCallback{}, r.callbacks...)
+	r.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(event)
+	}
+}
+
+// Devices returns all known devices sorted by ID.
+func (r *Registry) Devices() []DiscoveredDevice {
+	return r.filter(func(DiscoveredDevice) bool { return true })
+}
+
+// ByModel returns all known devices of the given model sorted by ID.
+func (r *Registry) ByModel(model string) []DiscoveredDevice {
+	return r.filter(func(d DiscoveredDevice) bool { return d.Model == model })
+}
+
+func (r *Registry) Lookup(id string) (DiscoveredDevice, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	device, ok := r.devices[id]
+	return device, ok
+}
+
+func (r *Registry) LookupMAC(mac string) (DiscoveredDevice, bool) {
+	devices := r.filter(func(d DiscoveredDevice) bool { return strings.EqualFold(d.MAC, mac) })
+	if len(devices) == 0 {
+		return DiscoveredDevice{}, false
+	}
+	return devices[0], true
+}
+
+func (r *Registry) LookupIP(ip string) (DiscoveredDevice, bool) {
+	devices := r.filter(func(d DiscoveredDevice) bool { return d.IP == ip })
+	if len(devices) == 0 {
+		return DiscoveredDevice{}, false
+	}
+	return devices[0], true
+}
+
+func (r *Registry) filter(keep func(DiscoveredDevice) bool) []DiscoveredDevice {
+	r.mu.Lock()
+	devices := make([]DiscoveredDevice, 0, len(r.devices))
+	for _, device := range r.devices {
+		if keep(device) {
+			devices = append(devices, device)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// Remove forgets the device with the given ID.
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	device, ok := r.devices[id]
+	delete(r.devices, id)
+	r.mu.Unlock()
+
+	if ok {
+		r.emit(RegistryEvent{Type: DeviceRemoved, Device: device})
+	}
+}
+
+// Prune removes every device that has not announced itself for maxAge.
+func (r *Registry) Prune(maxAge time.Duration) {
+	cutoff := time.Now().Add(-maxAge)
+	stale := r.filter(func(d DiscoveredDevice) bool { return d.LastSeen.Before(cutoff) })
+	for _, device := range stale {
+		r.Remove(device.ID)
+	}
+}
+
+// NewDevice instantiates the typed device (ShellyTRV, ShellyPlugS, ...)
+// matching the model of a known device, bound to the registry's
+// ConnectionManager.
+func (r *Registry) NewDevice(id string, opts ...DeviceOption) (Device, error) {
+	device, ok := r.Lookup(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown device %q", ErrInvalidArgument, id)
+	}
+	return r.conn.NewDevice(device, opts...)
+}
+
+// NewDevice instantiates the typed device matching a discovered device.
+func (c *ConnectionManager) NewDevice(
+	device DiscoveredDevice,
+	opts ...DeviceOption,
+) (Device, error) {
+	deviceId, err := device.DeviceId()
+	if err != nil {
+		return nil, err
+	}
+
+	switch modelDeviceTypes[device.Model] {
+	case shellyTRVDeviceType:
+		return c.NewShellyTRV(deviceId, opts...), nil
+	case shellyPlugSDeviceType:
+		return c.NewShellyPlugS(deviceId, opts...), nil
+	case shellyDW2DeviceType:
+		return c.NewShellyDW2(deviceId, opts...), nil
+	case shellyButton1DeviceType:
+		return c.NewShellyButton1(deviceId, opts...), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownModel, device.Model)
+	}
+}
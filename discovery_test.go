@@ -0,0 +1,113 @@
+package shelly
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/washed/shelly-go/shellytest"
+)
+
+func TestRegistryEvents(t *testing.T) {
+	r := NewConnectionManager(MQTT.NewClientOptions()).NewRegistry()
+
+	var events []RegistryEvent
+	r.OnEvent(func(event RegistryEvent) { events = append(events, event) })
+
+	announce := ShellyAnnounce{
+		ID:    "shellytrv-60A423DAE8DE",
+		Model: "SHTRV-01",
+		MAC:   "60A423DAE8DE",
+		IP:    "192.168.178.123",
+		FWVer: "20220811-152343/v2.1.8@5afc928c",
+	}
+	r.handleAnnounce(announce)
+	r.handleAnnounce(announce)
+	announce.IP = "192.168.178.124"
+	r.handleAnnounce(announce)
+	r.Remove(announce.ID)
+
+	want := []RegistryEventType{DeviceAdded, DeviceChanged, DeviceRemoved}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, event := range events {
+		if event.Type != want[i] {
+			t.Errorf("event %d: got %s, want %s", i, event.Type, want[i])
+		}
+	}
+	if events[1].Device.IP != "192.168.178.124" {
+		t.Errorf("changed event carries IP %s", events[1].Device.IP)
+	}
+}
+
+func TestRegistryNewDevice(t *testing.T) {
+	r := NewConnectionManager(MQTT.NewClientOptions()).NewRegistry()
+	r.handleAnnounce(ShellyAnnounce{ID: "shellyplug-s-EF6948", Model: "SHPLG-S"})
+	r.handleAnnounce(ShellyAnnounce{ID: "shellyfoo-123456", Model: "SHFOO-1"})
+
+	device, err := r.NewDevice("shellyplug-s-EF6948")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plug, ok := device.(ShellyPlugS)
+	if !ok {
+		t.Fatalf("got %T, want ShellyPlugS", device)
+	}
+	if plug.DeviceId != "EF6948" {
+		t.Errorf("got DeviceId %s, want EF6948", plug.DeviceId)
+	}
+
+	if _, err := r.NewDevice("shellyfoo-123456"); !errors.Is(err, ErrUnknownModel) {
+		t.Errorf("got %v, want ErrUnknownModel", err)
+	}
+}
+
+func TestRegistryDiscoverConcurrent(t *testing.T) {
+	conn, _ := newTestConnection(t)
+	r := conn.NewRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.DiscoverCtx(testContext(t)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var listeners int
+	for _, entry := range conn.router.match(r.announceTopic(), nil) {
+		listeners += len(entry.listeners)
+	}
+	if listeners != 1 {
+		t.Errorf("got %d announce listeners, want 1", listeners)
+	}
+}
+
+func TestRegistryTopicPrefix(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	r := conn.NewRegistry(WithRegistryTopicPrefix("home/shellies"))
+
+	if err := r.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	checkPublished(t, broker, shellytest.Publication{
+		Topic: "home/shellies/command", Payload: []byte("announce"), QoS: defaultQoS,
+	})
+	waitSubscribed(t, broker, "home/shellies/announce")
+
+	if err := r.RequestUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	checkPublished(t, broker, shellytest.Publication{
+		Topic: "home/shellies/command", Payload: []byte("update"), QoS: defaultQoS,
+	})
+	if _, ok := broker.LastPublished("shellies/command"); ok {
+		t.Error("published on the default command topic")
+	}
+}
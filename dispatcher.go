@@ -0,0 +1,158 @@
+package shelly
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+)
+
+// DispatchMetrics describes the message queue of a device.
+type DispatchMetrics struct {
+	QueueDepth    int
+	QueueCapacity int
+	Delivered     uint64
+	Dropped       uint64
+	Panics        uint64
+}
+
+// PanicHandler is called with the recovered value when a callback panics.
+type PanicHandler = func(deviceName string, topic string, recovered interface{})
+
+type dispatchJob struct {
+	listeners []*listener
+	client    MQTT.Client
+	message   MQTT.Message
+}
+
+// dispatcher delivers the messages of one device in order on its own
+// goroutine, so a slow or panicking callback only affects that device and
+// never paho's message router. The goroutine only runs while there is work.
+type dispatcher struct {
+	logger   *zerolog.Logger
+	capacity int
+	onPanic  func(topic string, recovered interface{})
+
+	// queue is a ring buffer of capacity jobs, allocated on first use.
+	mu      sync.Mutex
+	queue   []dispatchJob
+	head    int
+	size    int
+	running bool
+	stats   DispatchMetrics
+}
+
+func newDispatcher(
+	logger *zerolog.Logger,
+	capacity int,
+	onPanic func(topic string, recovered interface{}),
+) *dispatcher {
+	return &dispatcher{logger: logger, capacity: capacity, onPanic: onPanic}
+}
+
+// enqueue schedules delivery to listeners. If the queue is full the job is
+// dropped rather than stalling the caller.
+func (d *dispatcher) enqueue(job dispatchJob) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.size >= d.capacity {
+		d.stats.Dropped++
+		d.logger.Warn().
+			Str("topic", job.message.Topic()).
+			Msg("dispatch queue full, dropping message")
+		return
+	}
+
+	if d.queue == nil {
+		d.queue = make([]dispatchJob, d.capacity)
+	}
+	d.queue[(d.head+d.size)%d.capacity] = job
+	d.size++
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+}
+
+// enqueueFunc schedules fn in order with the messages of the device, as if
+// it were a listener of a message on topic.
+func (d *dispatcher) enqueueFunc(topic string, fn func()) {
+	d.enqueue(dispatchJob{
+		listeners: []*listener{{handler: func(MQTT.Client, MQTT.Message) { fn() }}},
+		message:   localMessage{topic: topic},
+	})
+}
+
+func (d *dispatcher) run() {
+	for {
+		d.mu.Lock()
+		if d.size == 0 {
+			d.running = false
+			d.mu.Unlock()
+			return
+		}
+		job := d.queue[d.head]
+		d.queue[d.head] = dispatchJob{}
+		d.head = (d.head + 1) % d.capacity
+		d.size--
+		d.mu.Unlock()
+
+		for _, l := range job.listeners {
+			d.deliver(job, l)
+		}
+
+		d.mu.Lock()
+		d.stats.Delivered++
+		d.mu.Unlock()
+	}
+}
+
+// deliver calls a single listener and recovers from its panics.
+func (d *dispatcher) deliver(job dispatchJob, l *listener) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			d.mu.Lock()
+			d.stats.Panics++
+			d.mu.Unlock()
+
+			d.logger.Error().
+				Str("topic", job.message.Topic()).
+				Str("panic", fmt.Sprint(recovered)).
+				Bytes("stack", debug.Stack()).
+				Msg("recovered from panic in callback")
+
+			if d.onPanic != nil {
+				d.onPanic(job.message.Topic(), recovered)
+			}
+		}
+	}()
+
+	l.handler(job.client, job.message)
+}
+
+func (d *dispatcher) metrics() DispatchMetrics {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	metrics := d.stats
+	metrics.QueueDepth = d.size
+	metrics.QueueCapacity = d.capacity
+	return metrics
+}
+
+// localMessage stands in for a message in jobs that do not come from the
+// broker, so that logs and panic reports can name a topic.
+type localMessage struct {
+	topic string
+}
+
+func (m localMessage) Duplicate() bool   { return false }
+func (m localMessage) Qos() byte         { return 0 }
+func (m localMessage) Retained() bool    { return false }
+func (m localMessage) Topic() string     { return m.topic }
+func (m localMessage) MessageID() uint16 { return 0 }
+func (m localMessage) Payload() []byte   { return nil }
+func (m localMessage) Ack()              {}
@@ -0,0 +1,72 @@
+package shelly
+
+import (
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestDispatcherOrderAndPanics(t *testing.T) {
+	var got []string
+	var panics []string
+	d := newDispatcher(&nopLogger, 16, func(topic string, recovered interface{}) {
+		panics = append(panics, topic)
+	})
+
+	handler := func(client MQTT.Client, message MQTT.Message) {
+		if message.Topic() == "2" {
+			panic("boom")
+		}
+		got = append(got, message.Topic())
+	}
+	listeners := []*listener{{handler: handler}, {handler: handler}}
+	for _, topic := range []string{"0", "1", "2", "3", "4"} {
+		d.enqueue(dispatchJob{listeners: listeners, message: testMessage{topic: topic}})
+	}
+	done := make(chan struct{})
+	d.enqueue(dispatchJob{
+		listeners: []*listener{{handler: func(MQTT.Client, MQTT.Message) { close(done) }}},
+		message:   testMessage{},
+	})
+	<-done
+
+	want := []string{"0", "0", "1", "1", "3", "3", "4", "4"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if len(panics) != 2 {
+		t.Errorf("got %d panics, want 2", len(panics))
+	}
+}
+
+func TestDispatcherDropsWhenFull(t *testing.T) {
+	started := make(chan struct{})
+	block := make(chan struct{})
+	d := newDispatcher(&nopLogger, 1, nil)
+
+	d.enqueue(dispatchJob{
+		listeners: []*listener{{handler: func(MQTT.Client, MQTT.Message) {
+			close(started)
+			<-block
+		}}},
+		message: testMessage{},
+	})
+	<-started
+
+	job := dispatchJob{
+		listeners: []*listener{{handler: func(MQTT.Client, MQTT.Message) {}}},
+		message:   testMessage{},
+	}
+	d.enqueue(job)
+	d.enqueue(job)
+	close(block)
+
+	if dropped := d.metrics().Dropped; dropped != 1 {
+		t.Errorf("got %d dropped, want 1", dropped)
+	}
+}
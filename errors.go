@@ -0,0 +1,20 @@
+package shelly
+
+import "errors"
+
+var (
+	// ErrNotConnected is returned when the MQTT client has no broker connection.
+	ErrNotConnected = errors.New("shelly: not connected")
+	// ErrTimeout is returned when the broker did not acknowledge in time.
+	ErrTimeout = errors.New("shelly: timeout")
+	// ErrInvalidArgument is returned when a command argument is out of range.
+	ErrInvalidArgument = errors.New("shelly: invalid argument")
+	// ErrInvalidPayload is returned by codecs for payloads they cannot decode.
+	ErrInvalidPayload = errors.New("shelly: invalid payload")
+	// ErrNotConfirmed is matched by NotConfirmedError.
+	ErrNotConfirmed = errors.New("shelly: not confirmed")
+	// ErrUnknownModel is returned for device models this package cannot handle.
+	ErrUnknownModel = errors.New("shelly: unknown model")
+	// ErrUnknownTopic is returned by DecodeMessage for topics it cannot decode.
+	ErrUnknownTopic = errors.New("shelly: unknown topic")
+)
@@ -0,0 +1,58 @@
+package shelly
+
+// ShellyInfo holds the fields of the info payload that all Gen1 devices
+// publish. It is embedded in the info types of the devices.
+type ShellyInfo struct {
+	WifiSta       ShellyInfoWifiSta      `json:"wifi_sta"`
+	Cloud         ShellyInfoCloud        `json:"cloud"`
+	MQTT          ShellyInfoMQTT         `json:"mqtt"`
+	Time          string                 `json:"time"`
+	Unixtime      int64                  `json:"unixtime"`
+	Serial        int                    `json:"serial"`
+	HasUpdate     bool                   `json:"has_update"`
+	MAC           string                 `json:"mac"`
+	CfgChangedCnt int                    `json:"cfg_changed_cnt"`
+	ActionsStats  ShellyInfoActionsStats `json:"actions_stats"`
+	Update        ShellyInfoUpdate       `json:"update"`
+	RAMTotal      int                    `json:"ram_total"`
+	RAMFree       int                    `json:"ram_free"`
+	FSSize        int                    `json:"fs_size"`
+	FSFree        int                    `json:"fs_free"`
+	Uptime        int                    `json:"uptime"`
+	FwInfo        ShellyInfoFwInfo       `json:"fw_info"`
+}
+
+type ShellyInfoWifiSta struct {
+	Connected bool   `json:"connected"`
+	SSID      string `json:"ssid"`
+	IP        string `json:"ip"`
+	RSSI      int    `json:"rssi"`
+}
+
+type ShellyInfoCloud struct {
+	Enabled   bool `json:"enabled"`
+	Connected bool `json:"connected"`
+}
+
+type ShellyInfoMQTT struct {
+	Connected bool `json:"connected"`
+}
+
+type ShellyInfoActionsStats struct {
+	Skipped int `json:"skipped"`
+}
+
+// ShellyInfoUpdate is the firmware update state. BetaVersion is empty if no
+// beta is offered.
+type ShellyInfoUpdate struct {
+	Status      string `json:"status"`
+	HasUpdate   bool   `json:"has_update"`
+	NewVersion  string `json:"new_version"`
+	OldVersion  string `json:"old_version"`
+	BetaVersion string `json:"beta_version"`
+}
+
+type ShellyInfoFwInfo struct {
+	Device string `json:"device"`
+	Fw     string `json:"fw"`
+}
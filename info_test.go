@@ -0,0 +1,83 @@
+package shelly
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden decodes the captured payload testdata/<name>.json into T and
+// compares the result, encoded as indented JSON, to testdata/<name>.golden.
+func checkGolden[T any](t *testing.T, name string) T {
+	t.Helper()
+	payload, err := os.ReadFile("testdata/" + name + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := JSONCodec[T]().Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := "testdata/" + name + ".golden"
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("decoded %s differs from %s:\n%s", name, golden, got)
+	}
+	checkAllFieldsDecoded(t, payload, got)
+	return value
+}
+
+// checkAllFieldsDecoded fails the test for fields of the payload that the
+// decoded value does not carry.
+func checkAllFieldsDecoded(t *testing.T, payload []byte, decoded []byte) {
+	t.Helper()
+	var in, out map[string]interface{}
+	if err := json.Unmarshal(payload, &in); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(decoded, &out); err != nil {
+		t.Fatal(err)
+	}
+	var missing []string
+	for key := range in {
+		if _, ok := out[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		t.Errorf("fields not decoded: %s", strings.Join(missing, ", "))
+	}
+}
+
+func TestShellyTRVInfoGolden(t *testing.T) {
+	info := checkGolden[ShellyTRVInfo](t, "shellytrv-info")
+	if info.MAC != "60A423DAE8DE" || info.FwInfo.Device != "shellytrv-60A423DAE8DE" {
+		t.Errorf("shared info fields not decoded: %+v", info.ShellyInfo)
+	}
+}
+
+func TestShellyDW2InfoGolden(t *testing.T) {
+	info := checkGolden[ShellyDW2Info](t, "shellydw2-info")
+	if info.WifiSta.IP != "192.168.178.86" || info.Tmp.TF != 63.14 {
+		t.Errorf("info fields not decoded: %+v", info)
+	}
+}
@@ -0,0 +1,36 @@
+package shelly
+
+import (
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+var nopLogger = zerolog.Nop()
+
+// defaultLogger is used by the package-level helpers and by every
+// ConnectionManager created without WithLogger.
+var defaultLogger atomic.Pointer[zerolog.Logger]
+
+func init() {
+	defaultLogger.Store(&nopLogger)
+}
+
+// SetDefaultLogger sets the logger of the package-level helpers and of
+// ConnectionManagers created afterwards without WithLogger. The package logs
+// nothing unless a logger is set.
+func SetDefaultLogger(logger zerolog.Logger) {
+	defaultLogger.Store(&logger)
+}
+
+func loadDefaultLogger() *zerolog.Logger {
+	return defaultLogger.Load()
+}
+
+// WithLogger sets the logger of a ConnectionManager and the devices bound to
+// it. Device loggers carry the device name as an additional field.
+func WithLogger(logger zerolog.Logger) ConnectionOption {
+	return func(c *ConnectionManager) {
+		c.logger = &logger
+	}
+}
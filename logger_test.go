@@ -0,0 +1,28 @@
+package shelly
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+)
+
+func TestDeviceLogger(t *testing.T) {
+	var out bytes.Buffer
+	conn := NewConnectionManager(MQTT.NewClientOptions(), WithLogger(zerolog.New(&out)))
+	trv := conn.NewShellyTRV("60A423DAE8DE")
+
+	trv.handleOnline(true)
+	if !strings.Contains(out.String(), `"DeviceName":"shellytrv-60A423DAE8DE"`) {
+		t.Errorf("device log lacks its name: %s", out.String())
+	}
+}
+
+func TestDefaultLoggerIsSilent(t *testing.T) {
+	conn := NewConnectionManager(MQTT.NewClientOptions())
+	if conn.logger.GetLevel() != zerolog.Disabled {
+		t.Errorf("got level %v, want disabled", conn.logger.GetLevel())
+	}
+}
@@ -0,0 +1,222 @@
+// Package metering accounts the energy consumed by Shelly Plug S devices.
+//
+// A Meter turns the energy counters that plugs report into consumption per
+// plug and hour. It keeps the hourly totals and the last counter of every
+// plug in a JSON file, so that consumption while the meter was not running
+// is still counted once it sees the plug again. Reports sum up the hours by
+// day or month and price them with a Tariff.
+package metering
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	shelly "github.com/washed/shelly-go"
+)
+
+// Meter accounts the consumption of plugs. It is safe for concurrent use.
+type Meter struct {
+	path     string
+	location *time.Location
+	tariff   Tariff
+
+	mu    sync.Mutex
+	plugs map[string]*plugData
+	dirty bool
+}
+
+// plugData is the persisted state of a plug. Hours maps the Unix time of
+// the start of each hour, in UTC, to the Wh consumed in it.
+type plugData struct {
+	Counter float64           `json:"counter"`
+	Updated time.Time         `json:"updated"`
+	Hours   map[int64]float64 `json:"hours"`
+}
+
+type fileData struct {
+	Plugs map[string]*plugData `json:"plugs"`
+}
+
+// Option configures a Meter.
+type Option func(*Meter)
+
+// WithLocation sets the time zone that days, months and tariff periods are
+// based on, time.Local by default.
+func WithLocation(location *time.Location) Option {
+	return func(m *Meter) {
+		m.location = location
+	}
+}
+
+// WithTariff sets the tariff that reports are priced with. Without one,
+// reports contain no costs.
+func WithTariff(tariff Tariff) Option {
+	return func(m *Meter) {
+		m.tariff = tariff
+	}
+}
+
+// Open returns a meter persisted to path, loading its state if the file
+// exists. An empty path keeps the state in memory only.
+func Open(path string, opts ...Option) (*Meter, error) {
+	m := &Meter{path: path, location: time.Local, plugs: map[string]*plugData{}}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if path == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file fileData
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for device, plug := range file.Plugs {
+		if plug.Hours == nil {
+			plug.Hours = map[int64]float64{}
+		}
+		m.plugs[device] = plug
+	}
+	return m, nil
+}
+
+// Save writes the state to the file of the meter, if it changed. The file
+// is replaced atomically, so a crash never leaves a partial file behind.
+func (m *Meter) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.path == "" || !m.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(fileData{Plugs: m.plugs})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Make sure the data is on disk before it replaces the old file.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+// Run saves the meter every interval until ctx is done, then saves it a
+// last time and returns the error of that save. Errors of the periodic
+// saves are passed to onError, which may be nil, and the save is retried at
+// the next interval.
+func (m *Meter) Run(ctx context.Context, interval time.Duration, onError func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Save(); err != nil && onError != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return m.Save()
+		}
+	}
+}
+
+// Track records the energy readings of plugS until the subscription ends.
+func (m *Meter) Track(ctx context.Context, plugS shelly.ShellyPlugS) (*shelly.Subscription, error) {
+	device := plugS.DeviceName()
+	return plugS.SubscribeEnergyCtx(ctx, func(energy shelly.ShellyPlugSEnergy) {
+		m.Record(device, energy.Counter, time.Now())
+	})
+}
+
+// Record accounts an energy counter reading of device, in Wh, taken at t.
+// The consumption since the previous reading is spread evenly over the
+// hours between the readings. A counter lower than the previous one means
+// the plug restarted counting, so all of it is new consumption. The first
+// reading of a device only sets the baseline.
+func (m *Meter) Record(device string, counter float64, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dirty = true
+
+	plug, ok := m.plugs[device]
+	if !ok {
+		m.plugs[device] = &plugData{Counter: counter, Updated: t, Hours: map[int64]float64{}}
+		return
+	}
+
+	delta := counter - plug.Counter
+	if counter < plug.Counter {
+		delta = counter
+	}
+	plug.distribute(plug.Updated, t, delta)
+	plug.Counter = counter
+	if t.After(plug.Updated) {
+		plug.Updated = t
+	}
+}
+
+func (p *plugData) distribute(from time.Time, to time.Time, wh float64) {
+	if wh == 0 {
+		return
+	}
+	if !to.After(from) {
+		p.Hours[hourOf(to)] += wh
+		return
+	}
+	span := float64(to.Sub(from))
+	for start := from; start.Before(to); {
+		end := time.Unix(hourOf(start), 0).Add(time.Hour)
+		if end.After(to) {
+			end = to
+		}
+		p.Hours[hourOf(start)] += wh * float64(end.Sub(start)) / span
+		start = end
+	}
+}
+
+// hourOf returns the Unix time of the start of the hour containing t.
+func hourOf(t time.Time) int64 {
+	return t.Unix() - t.Unix()%3600
+}
+
+// Devices returns the names of the plugs the meter has seen, sorted.
+func (m *Meter) Devices() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices := make([]string, 0, len(m.plugs))
+	for device := range m.plugs {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	return devices
+}
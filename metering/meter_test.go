@@ -0,0 +1,236 @@
+package metering
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	shelly "github.com/washed/shelly-go"
+	"github.com/washed/shelly-go/shellytest"
+)
+
+const plug = "shellyplug-s-EF6948"
+
+var start = time.Date(2023, 1, 13, 17, 30, 0, 0, time.UTC)
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestMeterRecord(t *testing.T) {
+	m, err := Open("", WithLocation(time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first reading only sets the baseline.
+	m.Record(plug, 1000, start)
+	// 60 Wh over an hour, half in each of two hours.
+	m.Record(plug, 1060, start.Add(time.Hour))
+	// The plug rebooted and consumed 5 Wh since.
+	m.Record(plug, 5, start.Add(90*time.Minute))
+
+	report := m.Report(start.Add(-time.Hour), start.Add(2*time.Hour), Hourly)
+	want := []float64{0.030, 0.035}
+	if len(report.Rows) != len(want) {
+		t.Fatalf("got rows %+v, want %v kWh", report.Rows, want)
+	}
+	for i, row := range report.Rows {
+		if !near(row.KWh, want[i]) {
+			t.Errorf("row %d: got %v kWh, want %v", i, row.KWh, want[i])
+		}
+	}
+	if !near(report.TotalKWh, 0.065) {
+		t.Errorf("got total %v kWh, want 0.065", report.TotalKWh)
+	}
+}
+
+func TestMeterRecordLargeCounter(t *testing.T) {
+	m, err := Open("", WithLocation(time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// float32 cannot tell these counters apart.
+	m.Record(plug, 20000000.0, start)
+	m.Record(plug, 20000000.5, start.Add(10*time.Minute))
+
+	report := m.Report(start.Add(-time.Hour), start.Add(time.Hour), Hourly)
+	if !near(report.TotalKWh, 0.0005) {
+		t.Errorf("got total %v kWh, want 0.0005", report.TotalKWh)
+	}
+}
+
+func TestMeterRunRetries(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	m, err := Open(filepath.Join(dir, "meter.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Record(plug, 1000, start)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 8)
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Run(ctx, time.Millisecond, func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+	}()
+	// Saving fails until the directory exists, without stopping Run.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-errs:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a save error")
+		}
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("got %v from the last save, want nil", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "meter.json")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMeterPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meter.json")
+	m, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Record(plug, 1000, start)
+	m.Record(plug, 1100, start.Add(10*time.Minute))
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Consumption while the meter was not running is counted on restart.
+	m, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Record(plug, 1300, start.Add(20*time.Minute))
+	report := m.Report(start.Add(-time.Hour), start.Add(time.Hour), Daily)
+	if !near(report.TotalKWh, 0.3) {
+		t.Errorf("got %v kWh, want 0.3", report.TotalKWh)
+	}
+	if devices := m.Devices(); len(devices) != 1 || devices[0] != plug {
+		t.Errorf("got devices %v, want [%s]", devices, plug)
+	}
+}
+
+func TestMeterReportCost(t *testing.T) {
+	tariff := TimeOfUseTariff{
+		Default: 0.30,
+		Periods: []TariffPeriod{{Start: 22 * 60, End: 6 * 60, Price: 0.20}},
+	}
+	m, err := Open("", WithLocation(time.UTC), WithTariff(tariff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2023, 1, 13, 0, 0, 0, 0, time.UTC)
+	m.Record(plug, 0, day.Add(21*time.Hour))
+	// 1 kWh at day rate from 21:00 to 22:00, 1 kWh at night rate after.
+	m.Record(plug, 1000, day.Add(22*time.Hour))
+	m.Record(plug, 2000, day.Add(23*time.Hour))
+	m.Record("shellyplug-s-other", 0, day)
+	m.Record("shellyplug-s-other", 500, day.Add(24*time.Hour+time.Hour))
+
+	report := m.Report(day, day.AddDate(0, 1, 0), Daily, plug)
+	if len(report.Rows) != 1 {
+		t.Fatalf("got rows %+v, want one day", report.Rows)
+	}
+	row := report.Rows[0]
+	if !near(row.KWh, 2) || !near(row.Cost, 0.5) || !row.Start.Equal(day) {
+		t.Errorf("got %+v, want 2 kWh for 0.50 on %v", row, day)
+	}
+
+	report = m.Report(day, day.AddDate(0, 1, 0), Monthly)
+	if len(report.Rows) != 2 || !near(report.TotalKWh, 2.5) {
+		t.Errorf("got %+v, want two devices with 2.5 kWh", report)
+	}
+}
+
+func TestTimeOfUseTariff(t *testing.T) {
+	tariff := TimeOfUseTariff{
+		Default: 0.30,
+		Periods: []TariffPeriod{
+			{Start: 22 * 60, End: 6 * 60, Weekdays: []time.Weekday{time.Friday}, Price: 0.20},
+			{Start: 12 * 60, End: 14 * 60, Price: 0.10},
+		},
+	}
+	friday := time.Date(2023, 1, 13, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at   time.Time
+		want float64
+	}{
+		{friday.Add(12 * time.Hour), 0.10},
+		{friday.Add(14 * time.Hour), 0.30},
+		{friday.Add(23 * time.Hour), 0.20},
+		// Saturday morning still belongs to the period starting on Friday.
+		{friday.Add(29 * time.Hour), 0.20},
+		{friday.Add(30 * time.Hour), 0.30},
+		// Friday morning belongs to Thursday night.
+		{friday.Add(3 * time.Hour), 0.30},
+	}
+	for _, test := range tests {
+		if got := tariff.Price(test.at); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.at, got, test.want)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	var c Clock
+	if err := c.UnmarshalText([]byte("06:30")); err != nil || c != 6*60+30 {
+		t.Errorf("got %v, %v, want 06:30", c, err)
+	}
+	for _, s := range []string{"6", "25:00", "12:60", "x:00"} {
+		if _, err := ParseClock(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+}
+
+func TestMeterTrack(t *testing.T) {
+	broker := shellytest.NewBroker()
+	conn := shelly.NewConnectionManager(
+		MQTT.NewClientOptions(), shelly.WithClientFactory(broker.NewClient),
+	)
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugS := conn.NewShellyPlugS("EF6948")
+	if _, err := m.Track(context.Background(), plugS); err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Now().Add(-time.Hour)
+	broker.Publish("shellies/shellyplug-s-EF6948/relay/0/energy", "6000")
+	broker.Publish("shellies/shellyplug-s-EF6948/relay/0/energy", "6600")
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		report := m.Report(from, time.Now().Add(time.Hour), Daily)
+		if near(report.TotalKWh, 0.01) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("energy readings not recorded")
+}
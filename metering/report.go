@@ -0,0 +1,134 @@
+package metering
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Period is the length of the rows of a report.
+type Period int
+
+const (
+	Hourly Period = iota
+	Daily
+	Monthly
+)
+
+func (p Period) String() string {
+	switch p {
+	case Hourly:
+		return "hour"
+	case Daily:
+		return "day"
+	case Monthly:
+		return "month"
+	default:
+		return fmt.Sprintf("Period(%d)", int(p))
+	}
+}
+
+// ParsePeriod parses "hour", "day" or "month".
+func ParsePeriod(s string) (Period, error) {
+	for _, p := range []Period{Hourly, Daily, Monthly} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown period %q, want hour, day or month", s)
+}
+
+// start returns the start of the period containing t, in the location of t.
+func (p Period) start(t time.Time) time.Time {
+	switch p {
+	case Daily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case Monthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return t.Truncate(time.Hour)
+	}
+}
+
+func (p Period) end(start time.Time) time.Time {
+	switch p {
+	case Daily:
+		return start.AddDate(0, 0, 1)
+	case Monthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.Add(time.Hour)
+	}
+}
+
+// ReportRow is the consumption of a device in one period. Cost is priced
+// by the hour, at the price the tariff has at the start of each hour.
+type ReportRow struct {
+	Device string    `json:"device"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	KWh    float64   `json:"kwh"`
+	Cost   float64   `json:"cost"`
+}
+
+// Report sums up the consumption of a time range.
+type Report struct {
+	Period    string      `json:"period"`
+	From      time.Time   `json:"from"`
+	To        time.Time   `json:"to"`
+	Rows      []ReportRow `json:"rows"`
+	TotalKWh  float64     `json:"total_kwh"`
+	TotalCost float64     `json:"total_cost"`
+}
+
+// Report sums up the hours starting in [from, to) by period, for the given
+// devices or all devices if none are given. Rows are sorted by device and
+// start, and periods without consumption are left out.
+func (m *Meter) Report(from time.Time, to time.Time, period Period, devices ...string) Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(devices) == 0 {
+		for device := range m.plugs {
+			devices = append(devices, device)
+		}
+	}
+	report := Report{Period: period.String(), From: from, To: to, Rows: []ReportRow{}}
+	for _, device := range devices {
+		plug, ok := m.plugs[device]
+		if !ok {
+			continue
+		}
+		rows := map[time.Time]*ReportRow{}
+		for hour, wh := range plug.Hours {
+			t := time.Unix(hour, 0).In(m.location)
+			if t.Before(from) || !t.Before(to) || wh == 0 {
+				continue
+			}
+			start := period.start(t)
+			row, ok := rows[start]
+			if !ok {
+				row = &ReportRow{Device: device, Start: start, End: period.end(start)}
+				rows[start] = row
+			}
+			kWh := wh / 1000
+			row.KWh += kWh
+			if m.tariff != nil {
+				row.Cost += kWh * m.tariff.Price(t)
+			}
+		}
+		for _, row := range rows {
+			report.Rows = append(report.Rows, *row)
+			report.TotalKWh += row.KWh
+			report.TotalCost += row.Cost
+		}
+	}
+	sort.Slice(report.Rows, func(i, j int) bool {
+		a, b := report.Rows[i], report.Rows[j]
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		return a.Start.Before(b.Start)
+	})
+	return report
+}
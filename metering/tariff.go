@@ -0,0 +1,110 @@
+package metering
+
+import (
+	"fmt"
+	"time"
+)
+
+// Tariff prices energy. Price returns the price per kWh at t.
+type Tariff interface {
+	Price(t time.Time) float64
+}
+
+// FlatTariff charges the same price per kWh at any time.
+type FlatTariff float64
+
+func (f FlatTariff) Price(time.Time) float64 {
+	return float64(f)
+}
+
+// TimeOfUseTariff charges the price of the first period containing a time,
+// and Default outside of all periods. Without periods it is a flat tariff.
+type TimeOfUseTariff struct {
+	Default float64        `json:"default"`
+	Periods []TariffPeriod `json:"periods,omitempty"`
+}
+
+// TariffPeriod is a daily period from Start up to End in the local time of
+// the meter. Periods with End before Start span midnight, e.g. 22:00 to
+// 06:00. Weekdays limits the period to days on which it starts, all days if
+// empty.
+type TariffPeriod struct {
+	Start    Clock          `json:"start"`
+	End      Clock          `json:"end"`
+	Weekdays []time.Weekday `json:"weekdays,omitempty"`
+	Price    float64        `json:"price"`
+}
+
+func (t TimeOfUseTariff) Price(at time.Time) float64 {
+	for _, p := range t.Periods {
+		if p.contains(at) {
+			return p.Price
+		}
+	}
+	return t.Default
+}
+
+func (p TariffPeriod) contains(at time.Time) bool {
+	clock := ClockOf(at)
+	start := at
+	switch {
+	case p.Start <= p.End:
+		if clock < p.Start || clock >= p.End {
+			return false
+		}
+	case clock >= p.Start:
+	case clock < p.End:
+		// The period started the day before.
+		start = at.AddDate(0, 0, -1)
+	default:
+		return false
+	}
+	if len(p.Weekdays) == 0 {
+		return true
+	}
+	for _, day := range p.Weekdays {
+		if day == start.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// Clock is a time of day in minutes after midnight. It is written as
+// "HH:MM" in JSON.
+type Clock int
+
+// ClockOf returns the time of day of t in its location.
+func ClockOf(t time.Time) Clock {
+	return Clock(t.Hour()*60 + t.Minute())
+}
+
+// ParseClock parses "HH:MM", with "24:00" meaning the end of the day.
+func ParseClock(s string) (Clock, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	clock := Clock(hours*60 + minutes)
+	if hours < 0 || minutes < 0 || minutes > 59 || clock > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return clock, nil
+}
+
+func (c Clock) String() string {
+	return fmt.Sprintf("%02d:%02d", int(c)/60, int(c)%60)
+}
+
+func (c Clock) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Clock) UnmarshalText(text []byte) error {
+	clock, err := ParseClock(string(text))
+	if err != nil {
+		return err
+	}
+	*c = clock
+	return nil
+}
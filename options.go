@@ -0,0 +1,81 @@
+package shelly
+
+// DeviceOption configures a device created by one of the New* constructors.
+type DeviceOption func(*deviceConfig)
+
+type deviceConfig struct {
+	topicPrefix       string
+	deviceName        string
+	publishQoS        byte
+	subscribeQoS      byte
+	retain            bool
+	windowCalibration WindowCalibration
+	connectionOptions []ConnectionOption
+}
+
+func newDeviceConfig(opts []DeviceOption) deviceConfig {
+	config := deviceConfig{
+		topicPrefix:       defaultTopicPrefix,
+		publishQoS:        defaultQoS,
+		subscribeQoS:      defaultQoS,
+		windowCalibration: DefaultWindowCalibration,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// WithTopicPrefix replaces the "shellies" prefix of every topic of the
+// device, for devices configured with a custom MQTT prefix.
+func WithTopicPrefix(prefix string) DeviceOption {
+	return func(c *deviceConfig) {
+		c.topicPrefix = prefix
+	}
+}
+
+// WithDeviceName replaces the "<type>-<id>" part of the device's topics, for
+// devices configured with a custom MQTT ID.
+func WithDeviceName(name string) DeviceOption {
+	return func(c *deviceConfig) {
+		c.deviceName = name
+	}
+}
+
+// WithPublishQoS sets the QoS of the commands sent to the device.
+func WithPublishQoS(qos byte) DeviceOption {
+	return func(c *deviceConfig) {
+		c.publishQoS = qos
+	}
+}
+
+// WithSubscribeQoS sets the QoS of the subscriptions to the device's topics.
+func WithSubscribeQoS(qos byte) DeviceOption {
+	return func(c *deviceConfig) {
+		c.subscribeQoS = qos
+	}
+}
+
+// WithRetain sets the retain flag of the commands sent to the device.
+func WithRetain(retain bool) DeviceOption {
+	return func(c *deviceConfig) {
+		c.retain = retain
+	}
+}
+
+// WithWindowCalibration sets the calibration of the window a ShellyDW2 is
+// mounted on. Other device types ignore it.
+func WithWindowCalibration(calibration WindowCalibration) DeviceOption {
+	return func(c *deviceConfig) {
+		c.windowCalibration = calibration
+	}
+}
+
+// WithConnectionOptions configures the ConnectionManager that the
+// standalone constructors, such as NewShellyTRV, create for the device. It is
+// ignored by the constructors of a ConnectionManager.
+func WithConnectionOptions(opts ...ConnectionOption) DeviceOption {
+	return func(c *deviceConfig) {
+		c.connectionOptions = append(c.connectionOptions, opts...)
+	}
+}
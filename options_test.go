@@ -0,0 +1,70 @@
+package shelly
+
+import (
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestDeviceOptionsTopics(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []DeviceOption
+		want string
+	}{
+		{"default", nil, "shellies/shellyplug-s-EF6948"},
+		{"prefix", []DeviceOption{WithTopicPrefix("home/plugs")}, "home/plugs/shellyplug-s-EF6948"},
+		{"name", []DeviceOption{WithDeviceName("kitchen")}, "shellies/kitchen"},
+		{
+			"prefix and name",
+			[]DeviceOption{WithTopicPrefix("home"), WithDeviceName("kitchen")},
+			"home/kitchen",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plugS := NewShellyPlugS("EF6948", MQTT.NewClientOptions(), test.opts...)
+			if got := plugS.baseTopic(); got != test.want {
+				t.Errorf("got base topic %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeviceOptionsQoS(t *testing.T) {
+	trv := NewShellyTRV(
+		"60A423DAE8DE", MQTT.NewClientOptions(),
+		WithPublishQoS(1), WithSubscribeQoS(2), WithRetain(true),
+	)
+	if trv.config.publishQoS != 1 || trv.config.subscribeQoS != 2 || !trv.config.retain {
+		t.Errorf("options not applied: %+v", trv.config)
+	}
+	if trv.subscriptions.qos != 2 {
+		t.Errorf("got subscribe QoS %d, want 2", trv.subscriptions.qos)
+	}
+}
+
+func TestBrokerFilter(t *testing.T) {
+	perTopic := NewConnectionManager(MQTT.NewClientOptions())
+	wildcard := NewConnectionManager(MQTT.NewClientOptions(), WithWildcardSubscription())
+
+	tests := []struct {
+		filter      string
+		topicPrefix string
+		want        string
+	}{
+		{"home/kitchen/relay/0", "", "home/#"},
+		{"home/kitchen/relay/0", "home", "home/#"},
+		{"home/shellies/kitchen/relay/0", "home/shellies", "home/shellies/#"},
+		// Filters outside the prefix fall back to their first level.
+		{"other/kitchen/relay/0", "home/shellies", "other/#"},
+	}
+	for _, test := range tests {
+		if got := perTopic.brokerFilter(test.filter, test.topicPrefix); got != test.filter {
+			t.Errorf("got %q, want %q", got, test.filter)
+		}
+		if got := wildcard.brokerFilter(test.filter, test.topicPrefix); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package shelly
+
+import (
+	"strings"
+	"sync"
+)
+
+// routeEntry connects a topic filter to the subscriptionSet that owns its
+// listeners. listeners is guarded by the set's mutex.
+type routeEntry struct {
+	filter    string
+	set       *subscriptionSet
+	listeners []*listener
+}
+
+type routeNode struct {
+	children map[string]*routeNode
+	single   *routeNode    // "+"
+	multi    []*routeEntry // "#"
+	entries  []*routeEntry // filters ending at this node
+}
+
+// router matches topics against MQTT topic filters using a trie with one
+// level per node, so the cost of a lookup depends on the depth of the topic
+// rather than the number of filters.
+type router struct {
+	mu   sync.RWMutex
+	root routeNode
+}
+
+func (r *router) add(entry *routeEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	node := &r.root
+	rest := entry.filter
+	for {
+		level, next, more := strings.Cut(rest, "/")
+		if level == "#" {
+			node.multi = append(node.multi, entry)
+			return
+		}
+		node = node.child(level)
+		if !more {
+			node.entries = append(node.entries, entry)
+			return
+		}
+		rest = next
+	}
+}
+
+func (r *router) remove(entry *routeEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.root.remove(entry.filter, entry)
+}
+
+// remove drops entry from the node reached by rest and prunes the nodes
+// left without entries or children on the way back up. It reports whether
+// n itself is empty afterwards.
+func (n *routeNode) remove(rest string, entry *routeEntry) bool {
+	level, next, more := strings.Cut(rest, "/")
+	switch {
+	case level == "#":
+		n.multi = removeEntry(n.multi, entry)
+	case level == "+":
+		if n.single != nil && n.single.removeBelow(next, more, entry) {
+			n.single = nil
+		}
+	default:
+		if child := n.children[level]; child != nil && child.removeBelow(next, more, entry) {
+			delete(n.children, level)
+		}
+	}
+	return n.empty()
+}
+
+// removeBelow removes entry from n if the filter ends here, or from the
+// subtree reached by rest otherwise.
+func (n *routeNode) removeBelow(rest string, more bool, entry *routeEntry) bool {
+	if !more {
+		n.entries = removeEntry(n.entries, entry)
+		return n.empty()
+	}
+	return n.remove(rest, entry)
+}
+
+func (n *routeNode) empty() bool {
+	return len(n.entries) == 0 && len(n.multi) == 0 &&
+		n.single == nil && len(n.children) == 0
+}
+
+// match appends every entry whose filter matches topic to out. It does not
+// allocate as long as out has enough capacity.
+func (r *router) match(topic string, out []*routeEntry) []*routeEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.root.match(topic, false, out)
+}
+
+func (n *routeNode) match(rest string, end bool, out []*routeEntry) []*routeEntry {
+	// "a/#" also matches "a" itself.
+	out = append(out, n.multi...)
+	if end {
+		return append(out, n.entries...)
+	}
+
+	level, next, more := strings.Cut(rest, "/")
+	if child := n.children[level]; child != nil {
+		out = child.match(next, !more, out)
+	}
+	if n.single != nil {
+		out = n.single.match(next, !more, out)
+	}
+	return out
+}
+
+func (n *routeNode) child(level string) *routeNode {
+	if level == "+" {
+		if n.single == nil {
+			n.single = &routeNode{}
+		}
+		return n.single
+	}
+
+	if n.children == nil {
+		n.children = map[string]*routeNode{}
+	}
+	child, ok := n.children[level]
+	if !ok {
+		child = &routeNode{}
+		n.children[level] = child
+	}
+	return child
+}
+
+// removeEntry returns entries without entry. It never modifies entries in
+// place, so slices handed out by match stay valid.
+func removeEntry(entries []*routeEntry, entry *routeEntry) []*routeEntry {
+	for i := range entries {
+		if entries[i] == entry {
+			return append(entries[:i:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,164 @@
+package shelly
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestRouterMatch(t *testing.T) {
+	filters := []string{
+		"shellies/a/relay/0",
+		"shellies/a/relay/0/power",
+		"shellies/a/#",
+		"shellies/+/online",
+		"shellies/#",
+		"shellies/+/relay/+",
+		"shellies/b/relay/0",
+	}
+	var r router
+	for _, filter := range filters {
+		r.add(&routeEntry{filter: filter})
+	}
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"shellies/a/relay/0", []string{
+			"shellies/#", "shellies/+/relay/+", "shellies/a/#", "shellies/a/relay/0",
+		}},
+		{"shellies/a/relay/0/power", []string{
+			"shellies/#", "shellies/a/#", "shellies/a/relay/0/power",
+		}},
+		{"shellies/a", []string{"shellies/#", "shellies/a/#"}},
+		{"shellies/c/online", []string{"shellies/#", "shellies/+/online"}},
+		{"shellies/c/relay/1", []string{"shellies/#", "shellies/+/relay/+"}},
+		{"shellies", []string{"shellies/#"}},
+		{"other/a/relay/0", nil},
+		{"shellies/c/relay", []string{"shellies/#"}},
+	}
+	for _, test := range tests {
+		t.Run(test.topic, func(t *testing.T) {
+			var got []string
+			for _, entry := range r.match(test.topic, nil) {
+				got = append(got, entry.filter)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRouterRemove(t *testing.T) {
+	var r router
+	first := &routeEntry{filter: "shellies/+/online"}
+	second := &routeEntry{filter: "shellies/+/online"}
+	wildcard := &routeEntry{filter: "shellies/#"}
+	r.add(first)
+	r.add(second)
+	r.add(wildcard)
+
+	r.remove(first)
+	r.remove(wildcard)
+	got := r.match("shellies/a/online", nil)
+	if len(got) != 1 || got[0] != second {
+		t.Errorf("got %v, want only the remaining entry", got)
+	}
+
+	// Removing an unknown filter must not panic.
+	r.remove(&routeEntry{filter: "shellies/x/y/z"})
+}
+
+func TestRouterRemovePrunes(t *testing.T) {
+	var r router
+	filters := []string{"#", "shellies/#", "shellies/+/online", "shellies/a/relay/0", "a/+/+/#"}
+	var entries []*routeEntry
+	for round := 0; round < 3; round++ {
+		for _, filter := range filters {
+			entry := &routeEntry{filter: filter}
+			r.add(entry)
+			entries = append(entries, entry)
+		}
+	}
+	for _, entry := range entries {
+		r.remove(entry)
+	}
+	if !r.root.empty() {
+		t.Errorf("got root %+v after removing every entry, want an empty trie", r.root)
+	}
+}
+
+// fleetRouter registers the routes of n Plug S devices.
+func fleetRouter(n int, set *subscriptionSet) *router {
+	r := &router{}
+	for i := 0; i < n; i++ {
+		base := fmt.Sprintf("shellies/shellyplug-s-%04d", i)
+		for _, suffix := range []string{"/online", "/relay/0", "/relay/0/power", "/info"} {
+			r.add(&routeEntry{filter: base + suffix, set: set})
+		}
+	}
+	return r
+}
+
+func BenchmarkRouterMatch(b *testing.B) {
+	r := fleetRouter(500, nil)
+	topic := "shellies/shellyplug-s-0250/relay/0/power"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf [8]*routeEntry
+		if len(r.match(topic, buf[:0])) != 1 {
+			b.Fatal("no match")
+		}
+	}
+}
+
+func BenchmarkRoute(b *testing.B) {
+	conn := NewConnectionManager(MQTT.NewClientOptions(), WithWildcardSubscription())
+	for i := 0; i < 500; i++ {
+		base := fmt.Sprintf("shellies/shellyplug-s-%04d", i)
+		dispatcher := newDispatcher(&nopLogger, dispatchQueueSize, nil)
+		set := newSubscriptionSet(conn, dispatcher, "", defaultQoS)
+		for _, suffix := range []string{"/online", "/relay/0", "/relay/0/power", "/info"} {
+			entry := &routeEntry{
+				filter:    base + suffix,
+				set:       set,
+				listeners: []*listener{{handler: func(MQTT.Client, MQTT.Message) {}}},
+			}
+			set.routes[entry.filter] = entry
+			conn.router.add(entry)
+		}
+	}
+	messages := make([]MQTT.Message, 500)
+	for i := range messages {
+		messages[i] = testMessage{
+			topic:   fmt.Sprintf("shellies/shellyplug-s-%04d/relay/0/power", i),
+			payload: []byte("12.5"),
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.route(conn.Client(), messages[i%len(messages)], "")
+	}
+}
+
+func BenchmarkLogMessageNop(b *testing.B) {
+	var message MQTT.Message = testMessage{
+		topic:   "shellies/shellyplug-s-0001/relay/0/power",
+		payload: []byte("12.5"),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logMessage(&nopLogger, message)
+	}
+}
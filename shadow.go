@@ -0,0 +1,74 @@
+package shelly
+
+import (
+	"context"
+	"sync"
+)
+
+// shadow holds the last known state of a device and is safe for concurrent
+// use.
+type shadow[T any] struct {
+	mu      sync.Mutex
+	value   T
+	changed chan struct{}
+
+	trackMu sync.Mutex
+	tracked bool
+}
+
+func (s *shadow[T]) get() T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value
+}
+
+// update applies a change to the state and wakes up every waiter.
+func (s *shadow[T]) update(apply func(state *T)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apply(&s.value)
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// wait blocks until done reports true for the state or ctx is done. It
+// returns the last state it saw either way.
+func (s *shadow[T]) wait(ctx context.Context, done func(state T) bool) (T, error) {
+	for {
+		s.mu.Lock()
+		value := s.value
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if done(value) {
+			return value, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return value, ctx.Err()
+		}
+	}
+}
+
+// track runs subscribe until it succeeds once, so the subscriptions backing
+// the state are only made a single time.
+func (s *shadow[T]) track(subscribe func() error) error {
+	s.trackMu.Lock()
+	defer s.trackMu.Unlock()
+
+	if s.tracked {
+		return nil
+	}
+	if err := subscribe(); err != nil {
+		return err
+	}
+	s.tracked = true
+	return nil
+}
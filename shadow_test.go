@@ -0,0 +1,38 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShadowWait(t *testing.T) {
+	var s shadow[int]
+
+	go func() {
+		for i := 1; i <= 3; i++ {
+			time.Sleep(time.Millisecond)
+			s.update(func(state *int) { *state = i })
+		}
+	}()
+
+	got, err := s.wait(context.Background(), func(state int) bool { return state == 3 })
+	if err != nil || got != 3 {
+		t.Fatalf("got %d, %v; want 3, nil", got, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = s.wait(ctx, func(state int) bool { return state == 4 })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestNotConfirmedError(t *testing.T) {
+	var err error = &NotConfirmedError{Field: "relay", Want: true, Err: ErrTimeout}
+	if !errors.Is(err, ErrNotConfirmed) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("%v should match ErrNotConfirmed and ErrTimeout", err)
+	}
+}
@@ -1,15 +1,26 @@
 package shelly
 
 import (
-	"fmt"
-	"strconv"
+	"context"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/rs/zerolog/log"
 )
 
+const shellyButton1DeviceType = "shellybutton1"
+
 type ShellyButton1 struct {
-	ShellyDevice
+	*ShellyDevice
+	state *shadow[ShellyButton1State]
+}
+
+// ShellyButton1State is the last known state of a ShellyButton1. Zero
+// timestamps mean nothing was received yet.
+type ShellyButton1State struct {
+	Battery           float32
+	BatteryUpdated    time.Time
+	InputEvent        ShellyButton1InputEvent
+	InputEventUpdated time.Time
 }
 
 type ShellyButton1InputEvent struct {
@@ -17,56 +28,86 @@ type ShellyButton1InputEvent struct {
 	EventCnt int32  `json:"event_cnt"`
 }
 
-func NewShellyButton1(deviceId string, mqttOpts *MQTT.ClientOptions) ShellyButton1 {
-	client := MQTT.NewClient(mqttOpts)
-	s := ShellyButton1{ShellyDevice{DeviceId: deviceId, mqttClient: client, mqttOpts: mqttOpts}}
-	log.Debug().Str("DeviceName", s.DeviceName()).Msg("New ShellyButton1")
-	return s
-}
-
-func (s ShellyButton1) Connect() {
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Error().
-			Str("DeviceName", s.DeviceName()).
-			Err(token.Error()).
-			Msg("Error connecting to MQTT!")
-	}
-	log.Info().Str("DeviceName", s.DeviceName()).Msg("connected")
-}
-
-func (s ShellyButton1) Close() {
-	s.mqttClient.Disconnect(disconnectQiesceTimeMs)
-	log.Info().Str("DeviceName", s.DeviceName()).Msg("disconnected")
+func NewShellyButton1(
+	deviceId string,
+	mqttOpts *MQTT.ClientOptions,
+	opts ...DeviceOption,
+) ShellyButton1 {
+	connectionOptions := newDeviceConfig(opts).connectionOptions
+	return NewConnectionManager(mqttOpts, connectionOptions...).NewShellyButton1(deviceId, opts...)
 }
 
-func (s ShellyButton1) DeviceName() string {
-	return fmt.Sprintf("shellybutton1-%s", s.DeviceId)
+func (s ShellyButton1) SubscribeBattery(batteryHandler func(float32)) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeBatteryCtx(ctx, batteryHandler)
 }
 
-func (s ShellyButton1) baseTopic() string {
-	return fmt.Sprintf("shellies/%s", s.DeviceName())
-}
-
-func (s ShellyButton1) SubscribeBattery(batteryHandler func(float32)) {
+func (s ShellyButton1) SubscribeBatteryCtx(
+	ctx context.Context,
+	batteryHandler func(float32),
+) (*Subscription, error) {
 	topic := s.baseTopic() + "/sensor/battery"
-	batteryCallback := func(batteryStr string) {
-		battery, err := strconv.ParseFloat(batteryStr, 32)
-		if err != nil {
-			log.Error().Str("powerStr", batteryStr).Msg("error parsing batteryStr as float32")
+	batteryCallback := func(battery float32) {
+		s.state.update(func(state *ShellyButton1State) {
+			state.Battery = battery
+			state.BatteryUpdated = time.Now()
+		})
+		if batteryHandler != nil {
+			batteryHandler(battery)
 		}
-		batteryHandler(float32(battery))
 	}
 
-	SubscribeStringHelper(s.mqttClient, topic, batteryCallback)
+	return s.subscribe(ctx, topic, decodingHandler(s.logger, Float32Codec, batteryCallback))
 }
 
 type ShellyButton1InputEventRawCallback = func(inputEvent ShellyButton1InputEvent)
 
 func (s ShellyButton1) SubscribeInputEventRaw(
 	inputEventCallback ShellyButton1InputEventRawCallback,
-) {
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeInputEventRawCtx(ctx, inputEventCallback)
+}
+
+func (s ShellyButton1) SubscribeInputEventRawCtx(
+	ctx context.Context,
+	inputEventCallback ShellyButton1InputEventRawCallback,
+) (*Subscription, error) {
 	topic := s.baseTopic() + "/input_event/0"
-	SubscribeJSONHelper(s.mqttClient, topic, inputEventCallback)
+	callback := func(inputEvent ShellyButton1InputEvent) {
+		s.state.update(func(state *ShellyButton1State) {
+			state.InputEvent = inputEvent
+			state.InputEventUpdated = time.Now()
+		})
+		if inputEventCallback != nil {
+			inputEventCallback(inputEvent)
+		}
+	}
+	return s.subscribe(ctx, topic, jsonHandler(s.logger, callback))
+}
+
+func (s ShellyButton1) State() ShellyButton1State {
+	return s.state.get()
+}
+
+func (s ShellyButton1) TrackState() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.TrackStateCtx(ctx)
+}
+
+// TrackStateCtx subscribes to the topics backing State without registering
+// any callbacks. Calling it again is a no-op.
+func (s ShellyButton1) TrackStateCtx(ctx context.Context) error {
+	return s.state.track(func() error {
+		_, err := subscribeAll(ctx, []func() (*Subscription, error){
+			func() (*Subscription, error) { return s.SubscribeBatteryCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeInputEventRawCtx(ctx, nil) },
+		})
+		return err
+	})
 }
 
 func (s ShellyButton1) SubscribeInputEvent(
@@ -74,7 +115,25 @@ func (s ShellyButton1) SubscribeInputEvent(
 	longPressHandler func(),
 	doubleShortPressHandler func(),
 	tripleShortPressHandler func(),
-) {
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeInputEventCtx(
+		ctx,
+		shortPressHandler,
+		longPressHandler,
+		doubleShortPressHandler,
+		tripleShortPressHandler,
+	)
+}
+
+func (s ShellyButton1) SubscribeInputEventCtx(
+	ctx context.Context,
+	shortPressHandler func(),
+	longPressHandler func(),
+	doubleShortPressHandler func(),
+	tripleShortPressHandler func(),
+) (*Subscription, error) {
 	inputEventCallback := func(inputEvent ShellyButton1InputEvent) {
 		switch inputEvent.Event {
 		case "S":
@@ -94,9 +153,31 @@ func (s ShellyButton1) SubscribeInputEvent(
 				tripleShortPressHandler()
 			}
 		default:
-			log.Error().Str("inputEvent.Event", inputEvent.Event).Msg("unknown input event")
+			s.logger.Error().Str("inputEvent.Event", inputEvent.Event).Msg("unknown input event")
 		}
 	}
 
-	s.SubscribeInputEventRaw(inputEventCallback)
+	return s.SubscribeInputEventRawCtx(ctx, inputEventCallback)
+}
+
+// Events streams raw input events until ctx is done, then closes the channel.
+func (s ShellyButton1) Events(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan ShellyButton1InputEvent, error) {
+	return openStream(ctx, s.logger, opts, s.SubscribeInputEventRawCtx)
+}
+
+// BatteryEvents streams battery readings until ctx is done, then closes the
+// channel.
+func (s ShellyButton1) BatteryEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan BatteryReading, error) {
+	subscribe := func(ctx context.Context, send func(BatteryReading)) (*Subscription, error) {
+		return s.SubscribeBatteryCtx(ctx, func(battery float32) {
+			send(BatteryReading{Battery: battery, Time: time.Now()})
+		})
+	}
+	return openStream(ctx, s.logger, opts, subscribe)
 }
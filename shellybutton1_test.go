@@ -0,0 +1,31 @@
+package shelly
+
+import (
+	"testing"
+)
+
+func TestShellyButton1InputEvents(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	button1 := conn.NewShellyButton1("3C6105E51C74")
+
+	presses := make(chan string, 4)
+	_, err := button1.SubscribeInputEvent(
+		func() { presses <- "S" },
+		func() { presses <- "L" },
+		func() { presses <- "SS" },
+		func() { presses <- "SSS" },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range []string{"L", "SSS", "S", "SS"} {
+		broker.Publish(
+			"shellies/shellybutton1-3C6105E51C74/input_event/0",
+			`{"event": "`+event+`", "event_cnt": 1}`,
+		)
+		if got := receive(t, presses); got != event {
+			t.Errorf("got %s handler, want %s", got, event)
+		}
+	}
+}
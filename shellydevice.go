@@ -1,11 +1,290 @@
 package shelly
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
 )
 
+// Device is implemented by every Shelly device type.
+type Device interface {
+	DeviceName() string
+	Connect() error
+	ConnectCtx(ctx context.Context) error
+	Close()
+	Online() bool
+	LastSeen() time.Time
+	SubscribeOnline(onlineCallback OnlineCallback) (*Subscription, error)
+	SubscribeOnlineCtx(ctx context.Context, onlineCallback OnlineCallback) (*Subscription, error)
+	TrackState() error
+	TrackStateCtx(ctx context.Context) error
+}
+
+// ShellyDevice is the shared base of all device types. It knows how to
+// name the device and where its topics live, and it is bound to the
+// ConnectionManager that owns the MQTT client.
 type ShellyDevice struct {
 	DeviceId   string
-	mqttClient MQTT.Client
-	mqttOpts   *MQTT.ClientOptions
+	deviceType string
+	config     deviceConfig
+	conn       *ConnectionManager
+	logger     *zerolog.Logger
+
+	dispatcher    *dispatcher
+	subscriptions *subscriptionSet
+
+	// onlineMu serializes subscribing to and releasing the online topic,
+	// which wait for the broker. mu is held briefly, as callbacks read it.
+	onlineMu           sync.Mutex
+	onlineSubscription *Subscription
+
+	mu              sync.Mutex
+	online          bool
+	onlineCallbacks []*onlineListener
+	lastSeen        time.Time
+}
+
+type OnlineCallback = func(online bool)
+
+type onlineListener struct {
+	callback OnlineCallback
+}
+
+func newShellyDevice(
+	conn *ConnectionManager,
+	deviceType string,
+	deviceId string,
+	opts []DeviceOption,
+) *ShellyDevice {
+	s := &ShellyDevice{
+		DeviceId:   deviceId,
+		deviceType: deviceType,
+		config:     newDeviceConfig(opts),
+		conn:       conn,
+	}
+	logger := conn.logger.With().Str("DeviceName", s.DeviceName()).Logger()
+	s.logger = &logger
+	s.dispatcher = newDispatcher(
+		s.logger, dispatchQueueSize, func(topic string, recovered interface{}) {
+			conn.reportPanic(s.DeviceName(), topic, recovered)
+		},
+	)
+	s.subscriptions = newSubscriptionSet(
+		conn, s.dispatcher, s.config.topicPrefix, s.config.subscribeQoS,
+	)
+	return s
+}
+
+func (s *ShellyDevice) Connect() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.ConnectCtx(ctx)
+}
+
+func (s *ShellyDevice) ConnectCtx(ctx context.Context) error {
+	if err := s.conn.ConnectCtx(ctx); err != nil {
+		return err
+	}
+	s.logger.Info().Msg("connected")
+	if err := s.trackOnline(ctx); err != nil {
+		// Release the reference taken above, or the connection never closes.
+		s.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *ShellyDevice) Close() {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	if err := s.untrackOnline(ctx); err != nil {
+		s.logger.Error().Err(err).Msg("Error releasing online topic!")
+	}
+	s.conn.Close()
+	s.logger.Info().Msg("disconnected")
+}
+
+// DeviceName returns the name of the device in its topics, "<type>-<id>"
+// unless set with WithDeviceName.
+func (s *ShellyDevice) DeviceName() string {
+	return deviceName(s.deviceType, s.DeviceId, s.config)
+}
+
+func deviceName(deviceType string, deviceId string, config deviceConfig) string {
+	if config.deviceName != "" {
+		return config.deviceName
+	}
+	return fmt.Sprintf("%s-%s", deviceType, deviceId)
+}
+
+// DispatchMetrics reports on the queue delivering this device's messages to
+// its callbacks.
+func (s *ShellyDevice) DispatchMetrics() DispatchMetrics {
+	return s.dispatcher.metrics()
+}
+
+// Connection returns the ConnectionManager the device is bound to.
+func (s *ShellyDevice) Connection() *ConnectionManager {
+	return s.conn
+}
+
+func (s *ShellyDevice) baseTopic() string {
+	return fmt.Sprintf("%s/%s", s.config.topicPrefix, s.DeviceName())
+}
+
+func (s *ShellyDevice) mqttClient() MQTT.Client {
+	return s.conn.mqttClient
 }
+
+// Online reports whether the device was online according to the last
+// message on its online topic. Tracking starts once the device is connected
+// or SubscribeOnline is called.
+func (s *ShellyDevice) Online() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.online
+}
+
+// LastSeen returns when the device last published anything this package has
+// subscribed to. It is the zero time if nothing was received yet.
+func (s *ShellyDevice) LastSeen() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSeen
+}
+
+func (s *ShellyDevice) SubscribeOnline(onlineCallback OnlineCallback) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeOnlineCtx(ctx, onlineCallback)
+}
+
+// SubscribeOnlineCtx calls onlineCallback whenever the device goes online or
+// offline. Gen1 devices publish "true" when they connect and the broker
+// publishes their last will "false" when they drop off.
+func (s *ShellyDevice) SubscribeOnlineCtx(
+	ctx context.Context,
+	onlineCallback OnlineCallback,
+) (*Subscription, error) {
+	if err := s.trackOnline(ctx); err != nil {
+		return nil, err
+	}
+
+	l := &onlineListener{callback: onlineCallback}
+	s.mu.Lock()
+	s.onlineCallbacks = append(s.onlineCallbacks, l)
+	s.mu.Unlock()
+
+	// The online topic itself stays subscribed to keep Online up to date.
+	return newSubscription(func(ctx context.Context) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i := range s.onlineCallbacks {
+			if s.onlineCallbacks[i] == l {
+				s.onlineCallbacks = append(s.onlineCallbacks[:i:i], s.onlineCallbacks[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}), nil
+}
+
+// OnlineEvents streams online state changes until ctx is done, then closes
+// the channel.
+func (s *ShellyDevice) OnlineEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan OnlineReading, error) {
+	subscribe := func(ctx context.Context, send func(OnlineReading)) (*Subscription, error) {
+		return s.SubscribeOnlineCtx(ctx, func(online bool) {
+			send(OnlineReading{Online: online, Time: time.Now()})
+		})
+	}
+	return openStream(ctx, s.logger, opts, subscribe)
+}
+
+// trackOnline subscribes to the online topic unless that already happened.
+func (s *ShellyDevice) trackOnline(ctx context.Context) error {
+	s.onlineMu.Lock()
+	defer s.onlineMu.Unlock()
+	if s.onlineSubscription != nil {
+		return nil
+	}
+
+	topic := s.baseTopic() + "/online"
+	handler := decodingHandler(s.logger, BoolCodec, s.handleOnline)
+	subscription, err := s.subscriptions.subscribe(ctx, topic, handler)
+	if err != nil {
+		return err
+	}
+	s.onlineSubscription = subscription
+	return nil
+}
+
+// untrackOnline releases the online topic, if trackOnline subscribed to it.
+func (s *ShellyDevice) untrackOnline(ctx context.Context) error {
+	s.onlineMu.Lock()
+	defer s.onlineMu.Unlock()
+	if s.onlineSubscription == nil {
+		return nil
+	}
+	subscription := s.onlineSubscription
+	s.onlineSubscription = nil
+	return subscription.UnsubscribeCtx(ctx)
+}
+
+func (s *ShellyDevice) handleOnline(online bool) {
+	s.mu.Lock()
+	s.online = online
+	if online {
+		// "false" is the last will published by the broker, not the device.
+		s.lastSeen = time.Now()
+	}
+	listeners := append([]*onlineListener{}, s.onlineCallbacks...)
+	s.mu.Unlock()
+
+	s.logger.Info().Bool("online", online).Msg("online state")
+	for _, l := range listeners {
+		l.callback(online)
+	}
+}
+
+// touch records that a message from the device was received.
+func (s *ShellyDevice) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = time.Now()
+}
+
+// publish sends a command to the device with its configured QoS and retain
+// flag.
+func (s *ShellyDevice) publish(ctx context.Context, topic string, payload interface{}) error {
+	return checkedPublish(
+		ctx, s.logger, s.mqttClient(), topic, s.config.publishQoS, s.config.retain, payload,
+	)
+}
+
+// subscribe subscribes to topic and records that the device was seen
+// whenever a message arrives.
+func (s *ShellyDevice) subscribe(
+	ctx context.Context,
+	topic string,
+	handler MQTT.MessageHandler,
+) (*Subscription, error) {
+	touchingHandler := func(client MQTT.Client, message MQTT.Message) {
+		s.touch()
+		handler(client, message)
+	}
+	return s.subscriptions.subscribe(ctx, topic, touchingHandler)
+}
+
+var (
+	_ Device = ShellyTRV{}
+	_ Device = ShellyPlugS{}
+	_ Device = ShellyDW2{}
+	_ Device = ShellyButton1{}
+)
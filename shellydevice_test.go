@@ -0,0 +1,262 @@
+package shelly
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// trackedDevice is a device tracking its state, as used by TestDeviceState.
+type trackedDevice struct {
+	trackState func() error
+	// matches reports whether the state of the device is the expected one.
+	matches func() bool
+}
+
+func trackTRV(want func(state ShellyTRVState) bool) func(*ConnectionManager) trackedDevice {
+	return func(conn *ConnectionManager) trackedDevice {
+		trv := conn.NewShellyTRV("60A423DAE8DE")
+		return trackedDevice{trv.TrackState, func() bool { return want(trv.State()) }}
+	}
+}
+
+func trackDW2(want func(state ShellyDW2State) bool) func(*ConnectionManager) trackedDevice {
+	return func(conn *ConnectionManager) trackedDevice {
+		dw2 := conn.NewShellyDW2("C92B94")
+		return trackedDevice{dw2.TrackState, func() bool { return want(dw2.State()) }}
+	}
+}
+
+func trackButton1(
+	want func(state ShellyButton1State) bool,
+) func(*ConnectionManager) trackedDevice {
+	return func(conn *ConnectionManager) trackedDevice {
+		button1 := conn.NewShellyButton1("3C6105E51C74")
+		return trackedDevice{button1.TrackState, func() bool { return want(button1.State()) }}
+	}
+}
+
+func trackPlugS(want func(state ShellyPlugSState) bool) func(*ConnectionManager) trackedDevice {
+	return func(conn *ConnectionManager) trackedDevice {
+		plugS := conn.NewShellyPlugS("EF6948")
+		return trackedDevice{plugS.TrackState, func() bool { return want(plugS.State()) }}
+	}
+}
+
+func TestDeviceState(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  func(conn *ConnectionManager) trackedDevice
+		topic   string
+		payload string
+	}{
+		{
+			"trv status",
+			trackTRV(func(state ShellyTRVState) bool {
+				return state.Status.TargetT.Value == 21.5 && state.Status.Bat == 87
+			}),
+			"shellies/shellytrv-60A423DAE8DE/status", shellyTRVStatusJSON,
+		},
+		{
+			"trv info",
+			trackTRV(func(state ShellyTRVState) bool {
+				return len(state.Info.Thermostats) == 1 && state.Info.Bat.Voltage == 3.127
+			}),
+			"shellies/shellytrv-60A423DAE8DE/info", ShellyTRVInfoJSON,
+		},
+		{
+			"dw2 open",
+			trackDW2(func(state ShellyDW2State) bool { return state.Open }),
+			"shellies/shellydw2-C92B94/sensor/state", "open",
+		},
+		{
+			"dw2 close",
+			trackDW2(func(state ShellyDW2State) bool {
+				return !state.Open && !state.OpenUpdated.IsZero()
+			}),
+			"shellies/shellydw2-C92B94/sensor/state", "close",
+		},
+		{
+			"dw2 info",
+			trackDW2(func(state ShellyDW2State) bool {
+				return state.Info.Sensor.IsOpen() && state.Info.Accel.Tilt == 8
+			}),
+			"shellies/shellydw2-C92B94/info",
+			`{"sensor": {"state": "open", "is_valid": true}, "accel": {"tilt": 8}}`,
+		},
+		{
+			"dw2 tilt",
+			trackDW2(func(state ShellyDW2State) bool { return state.Tilt == 12 }),
+			"shellies/shellydw2-C92B94/sensor/tilt", "12",
+		},
+		{
+			"dw2 vibration",
+			trackDW2(func(state ShellyDW2State) bool { return state.Vibration }),
+			"shellies/shellydw2-C92B94/sensor/vibration", "1",
+		},
+		{
+			"dw2 lux",
+			trackDW2(func(state ShellyDW2State) bool { return state.Lux == 41 }),
+			"shellies/shellydw2-C92B94/sensor/lux", "41",
+		},
+		{
+			"dw2 illumination",
+			trackDW2(func(state ShellyDW2State) bool { return state.Illumination == "twilight" }),
+			"shellies/shellydw2-C92B94/sensor/illumination", "twilight",
+		},
+		{
+			"dw2 temperature",
+			trackDW2(func(state ShellyDW2State) bool { return state.Temperature == 17.3 }),
+			"shellies/shellydw2-C92B94/sensor/temperature", "17.3",
+		},
+		{
+			"dw2 battery",
+			trackDW2(func(state ShellyDW2State) bool { return state.Battery == 87 }),
+			"shellies/shellydw2-C92B94/sensor/battery", "87",
+		},
+		{
+			"dw2 error",
+			trackDW2(func(state ShellyDW2State) bool {
+				return state.SensorError == 1 && !state.SensorsUpdated.IsZero()
+			}),
+			"shellies/shellydw2-C92B94/sensor/error", "1",
+		},
+		{
+			"button1 battery",
+			trackButton1(func(state ShellyButton1State) bool { return state.Battery == 87 }),
+			"shellies/shellybutton1-3C6105E51C74/sensor/battery", "87",
+		},
+		{
+			"button1 input event",
+			trackButton1(func(state ShellyButton1State) bool {
+				return state.InputEvent == ShellyButton1InputEvent{Event: "SS", EventCnt: 4}
+			}),
+			"shellies/shellybutton1-3C6105E51C74/input_event/0",
+			`{"event": "SS", "event_cnt": 4}`,
+		},
+		{
+			"plug s relay on",
+			trackPlugS(func(state ShellyPlugSState) bool { return state.RelayOn }),
+			"shellies/shellyplug-s-EF6948/relay/0", "on",
+		},
+		{
+			"plug s relay off",
+			trackPlugS(func(state ShellyPlugSState) bool {
+				return !state.RelayOn && !state.RelayUpdated.IsZero()
+			}),
+			"shellies/shellyplug-s-EF6948/relay/0", "off",
+		},
+		{
+			"plug s power",
+			trackPlugS(func(state ShellyPlugSState) bool { return state.Power == 42.25 }),
+			"shellies/shellyplug-s-EF6948/relay/0/power", "42.25",
+		},
+		{
+			"plug s energy",
+			trackPlugS(func(state ShellyPlugSState) bool { return state.Energy == 25.5 }),
+			"shellies/shellyplug-s-EF6948/relay/0/energy", "1530",
+		},
+		{
+			"plug s temperature",
+			trackPlugS(func(state ShellyPlugSState) bool { return state.Temperature == 41.2 }),
+			"shellies/shellyplug-s-EF6948/temperature", "41.2",
+		},
+		{
+			"plug s temperature_f",
+			trackPlugS(func(state ShellyPlugSState) bool { return state.TemperatureF == 106.16 }),
+			"shellies/shellyplug-s-EF6948/temperature_f", "106.16",
+		},
+		{
+			"plug s overtemperature",
+			trackPlugS(func(state ShellyPlugSState) bool { return state.Overtemperature }),
+			"shellies/shellyplug-s-EF6948/overtemperature", "1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, broker := newTestConnection(t)
+			device := test.device(conn)
+			if err := device.trackState(); err != nil {
+				t.Fatal(err)
+			}
+
+			broker.Publish(test.topic, test.payload)
+			deadline := time.Now().Add(time.Second)
+			for !device.matches() {
+				if time.Now().After(deadline) {
+					t.Fatal("state not updated")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestShellyDeviceOnline(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	trv := conn.NewShellyTRV("60A423DAE8DE")
+
+	calls := make(chan bool, 2)
+	if _, err := trv.SubscribeOnline(func(online bool) { calls <- online }); err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Publish("shellies/shellytrv-60A423DAE8DE/online", "true")
+	if !receive(t, calls) {
+		t.Error("got offline, want online")
+	}
+	if !trv.Online() {
+		t.Error("device should be online")
+	}
+	seen := trv.LastSeen()
+	if seen.IsZero() {
+		t.Error("online device should have been seen")
+	}
+
+	broker.Publish("shellies/shellytrv-60A423DAE8DE/online", "false")
+	if receive(t, calls) {
+		t.Error("got online, want offline")
+	}
+	if trv.Online() {
+		t.Error("device should be offline")
+	}
+	if trv.LastSeen() != seen {
+		t.Error("last will must not count as seeing the device")
+	}
+}
+
+func TestShellyDeviceTrackOnlineConcurrent(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	plugS := conn.NewShellyPlugS("EF6948")
+
+	calls := make(chan bool, 8)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := plugS.ConnectCtx(testContext(t)); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := plugS.SubscribeOnlineCtx(testContext(t), func(online bool) { calls <- online })
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	broker.Publish("shellies/shellyplug-s-EF6948/online", "true")
+	receive(t, calls)
+	select {
+	case <-calls:
+		t.Error("online callback ran twice for one message")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	plugS.Close()
+	if broker.Subscribed("shellies/shellyplug-s-EF6948/online") {
+		t.Error("online topic still subscribed after Close")
+	}
+}
@@ -1,16 +1,72 @@
 package shelly
 
 import (
-	"fmt"
+	"context"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/rs/zerolog/log"
 )
 
+const shellyDW2DeviceType = "shellydw2"
+
 type ShellyDW2 struct {
-	ShellyDevice
+	*ShellyDevice
+	state *shadow[ShellyDW2State]
+}
+
+// ShellyDW2State is the last known state of a ShellyDW2. Zero timestamps mean
+// nothing was received yet. SensorsUpdated is the time of the last reading
+// on any sensor topic other than sensor/state.
+type ShellyDW2State struct {
+	Open           bool
+	OpenUpdated    time.Time
+	Tilt           int
+	Vibration      bool
+	Lux            float32
+	Illumination   string
+	Temperature    float32
+	Battery        float32
+	SensorError    int
+	SensorsUpdated time.Time
+	Window         WindowPosition
+	WindowUpdated  time.Time
+	Info           ShellyDW2Info
+	InfoUpdated    time.Time
+}
+
+// Reasons a DW2 reports in act_reasons for waking up.
+const (
+	WakeReasonButton   = "button"
+	WakeReasonSensor   = "sensor"
+	WakeReasonPeriodic = "periodic"
+	WakeReasonPowerOn  = "poweron"
+)
+
+// ShellyDW2WakeUp tells why a DW2 woke up, together with the info message
+// it published on waking.
+type ShellyDW2WakeUp struct {
+	Reasons []string
+	Info    ShellyDW2Info
+	Time    time.Time
 }
 
+// HasReason reports whether reason is one of the reasons for waking up.
+func (w ShellyDW2WakeUp) HasReason(reason string) bool {
+	for _, r := range w.Reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// vibrationCodec decodes sensor/vibration, which is 1 if a vibration was
+// detected, 0 if not and -1 if detection is disabled.
+var vibrationCodec Codec[bool] = CodecFunc[bool](func(payload []byte) (bool, error) {
+	value, err := IntCodec.Decode(payload)
+	return value > 0, err
+})
+
 type ShellyDW2Sensor struct {
 	State   string `json:"state"`
 	IsValid bool   `json:"is_valid"`
@@ -26,114 +82,307 @@ type ShellyDW2Accel struct {
 	Vibration int `json:"vibration"`
 }
 
+// ShellyDW2Info is the info payload of a DW2. ActReasons lists why the
+// device woke up, e.g. "sensor", "periodic" or "button".
 type ShellyDW2Info struct {
-	Sensor ShellyDW2Sensor `json:"sensor"`
-	Bat    ShellyInfoBat   `json:"bat"`
-	Tmp    ShellyInfoTmp   `json:"tmp"`
-	Lux    ShellyInfoLux   `json:"lux"`
-	Accel  ShellyDW2Accel  `json:"accel"`
-}
-
-/*
-Implement the rest the remaining info fields if necessary?
-{
-    "wifi_sta": {
-        "connected": true,
-        "ssid": "",
-        "ip": "192.168.178.86",
-        "rssi": -37
-    },
-    "cloud": {
-        "enabled": true,
-        "connected": false
-    },
-    "mqtt": {
-        "connected": true
-    },
-    "time": "",
-    "unixtime": 0,
-    "serial": 1,
-    "has_update": false,
-    "mac": "485519C92B94",
-    "cfg_changed_cnt": 0,
-    "actions_stats": {
-        "skipped": 0
-    },
-    "is_valid": true,
-    "tmp": {
-        "tC": 17.30,
-        "tF": 63.14,
-    },
-    "accel": {
-        "tilt": 8,
-        "vibration": -1
-    },
-    "act_reasons": [
-        "sensor"
-    ],
-    "sensor_error": 0,
-    "update": {
-        "status": "unknown",
-        "has_update": false,
-        "new_version": "",
-        "old_version": "20220209-093605/v1.11.8-g8c7bb8d"
-    },
-    "ram_total": 51352,
-    "ram_free": 40544,
-    "fs_size": 233681,
-    "fs_free": 154867,
-    "uptime": 1
-}
-*/
-
-func NewShellyDW2(deviceId string, mqttOpts *MQTT.ClientOptions) ShellyDW2 {
-	client := MQTT.NewClient(mqttOpts)
-	s := ShellyDW2{ShellyDevice{DeviceId: deviceId, mqttClient: client, mqttOpts: mqttOpts}}
-	log.Debug().Str("DeviceName", s.DeviceName()).Msg("New ShellyDW2")
-	return s
-}
-
-func (s ShellyDW2) Connect() {
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Error().
-			Str("DeviceName", s.DeviceName()).
-			Err(token.Error()).
-			Msg("Error connecting to MQTT!")
-	}
-	log.Info().Str("DeviceName", s.DeviceName()).Msg("connected")
-}
-
-func (s ShellyDW2) Close() {
-	s.mqttClient.Disconnect(disconnectQiesceTimeMs)
-	log.Info().Str("DeviceName", s.DeviceName()).Msg("disconnected")
+	ShellyInfo
+	IsValid     bool            `json:"is_valid"`
+	Sensor      ShellyDW2Sensor `json:"sensor"`
+	Bat         ShellyInfoBat   `json:"bat"`
+	Tmp         ShellyInfoTmp   `json:"tmp"`
+	Lux         ShellyInfoLux   `json:"lux"`
+	Accel       ShellyDW2Accel  `json:"accel"`
+	ActReasons  []string        `json:"act_reasons"`
+	SensorError int             `json:"sensor_error"`
 }
 
-func (s ShellyDW2) DeviceName() string {
-	return fmt.Sprintf("shellydw2-%s", s.DeviceId)
+func NewShellyDW2(
+	deviceId string,
+	mqttOpts *MQTT.ClientOptions,
+	opts ...DeviceOption,
+) ShellyDW2 {
+	connectionOptions := newDeviceConfig(opts).connectionOptions
+	return NewConnectionManager(mqttOpts, connectionOptions...).NewShellyDW2(deviceId, opts...)
 }
 
-func (s ShellyDW2) baseTopic() string {
-	return fmt.Sprintf("shellies/%s", s.DeviceName())
+func (s ShellyDW2) SubscribeOpenState(
+	openHandler func(),
+	closeHandler func(),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeOpenStateCtx(ctx, openHandler, closeHandler)
 }
 
-func (s ShellyDW2) SubscribeOpenState(openHandler func(), closeHandler func()) {
+func (s ShellyDW2) SubscribeOpenStateCtx(
+	ctx context.Context,
+	openHandler func(),
+	closeHandler func(),
+) (*Subscription, error) {
 	topic := s.baseTopic() + "/sensor/state"
-	openStateCallback := func(windowState string) {
-		if windowState == "open" {
+	openStateCallback := func(open bool) {
+		s.state.update(func(state *ShellyDW2State) {
+			state.Open = open
+			state.OpenUpdated = time.Now()
+		})
+
+		if open && openHandler != nil {
 			openHandler()
-		} else if windowState == "close" {
+		} else if !open && closeHandler != nil {
 			closeHandler()
-		} else {
-			log.Error().Str("state", windowState).Msg("received unknown state value")
 		}
 	}
 
-	SubscribeStringHelper(s.mqttClient, topic, openStateCallback)
+	return s.subscribe(ctx, topic, decodingHandler(s.logger, OpenCloseCodec, openStateCallback))
 }
 
 type ShellyDW2InfoCallback = func(info ShellyDW2Info)
 
-func (s ShellyDW2) SubscribeInfo(infoCallback ShellyDW2InfoCallback) {
+func (s ShellyDW2) SubscribeInfo(infoCallback ShellyDW2InfoCallback) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeInfoCtx(ctx, infoCallback)
+}
+
+func (s ShellyDW2) SubscribeInfoCtx(
+	ctx context.Context,
+	infoCallback ShellyDW2InfoCallback,
+) (*Subscription, error) {
 	topic := s.baseTopic() + "/info"
-	SubscribeJSONHelper(s.mqttClient, topic, infoCallback)
+	callback := func(info ShellyDW2Info) {
+		s.state.update(func(state *ShellyDW2State) {
+			state.Info = info
+			state.InfoUpdated = time.Now()
+		})
+		if infoCallback != nil {
+			infoCallback(info)
+		}
+	}
+	return s.subscribe(ctx, topic, jsonHandler(s.logger, callback))
+}
+
+// subscribeDW2Sensor subscribes to sensor/<sensor>, records each reading
+// with apply and passes it on to callback.
+func subscribeDW2Sensor[T any](
+	ctx context.Context,
+	s ShellyDW2,
+	sensor string,
+	codec Codec[T],
+	apply func(state *ShellyDW2State, value T),
+	callback func(T),
+) (*Subscription, error) {
+	topic := s.baseTopic() + "/sensor/" + sensor
+	sensorCallback := func(value T) {
+		s.state.update(func(state *ShellyDW2State) {
+			apply(state, value)
+			state.SensorsUpdated = time.Now()
+		})
+		if callback != nil {
+			callback(value)
+		}
+	}
+	return s.subscribe(ctx, topic, decodingHandler(s.logger, codec, sensorCallback))
+}
+
+func (s ShellyDW2) SubscribeTilt(tiltHandler func(int)) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeTiltCtx(ctx, tiltHandler)
+}
+
+// SubscribeTiltCtx reports the tilt angle in degrees, or -1 while the
+// sensor is not calibrated.
+func (s ShellyDW2) SubscribeTiltCtx(
+	ctx context.Context,
+	tiltHandler func(int),
+) (*Subscription, error) {
+	apply := func(state *ShellyDW2State, tilt int) { state.Tilt = tilt }
+	return subscribeDW2Sensor(ctx, s, "tilt", IntCodec, apply, tiltHandler)
+}
+
+func (s ShellyDW2) SubscribeVibration(vibrationHandler func(bool)) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeVibrationCtx(ctx, vibrationHandler)
+}
+
+// SubscribeVibrationCtx reports whether a vibration was detected.
+func (s ShellyDW2) SubscribeVibrationCtx(
+	ctx context.Context,
+	vibrationHandler func(bool),
+) (*Subscription, error) {
+	apply := func(state *ShellyDW2State, vibration bool) { state.Vibration = vibration }
+	return subscribeDW2Sensor(ctx, s, "vibration", vibrationCodec, apply, vibrationHandler)
+}
+
+func (s ShellyDW2) SubscribeLux(luxHandler func(float32)) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeLuxCtx(ctx, luxHandler)
+}
+
+func (s ShellyDW2) SubscribeLuxCtx(
+	ctx context.Context,
+	luxHandler func(float32),
+) (*Subscription, error) {
+	apply := func(state *ShellyDW2State, lux float32) { state.Lux = lux }
+	return subscribeDW2Sensor(ctx, s, "lux", Float32Codec, apply, luxHandler)
+}
+
+func (s ShellyDW2) SubscribeIllumination(
+	illuminationHandler func(string),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeIlluminationCtx(ctx, illuminationHandler)
+}
+
+// SubscribeIlluminationCtx reports the illumination level, one of "dark",
+// "twilight" or "bright".
+func (s ShellyDW2) SubscribeIlluminationCtx(
+	ctx context.Context,
+	illuminationHandler func(string),
+) (*Subscription, error) {
+	apply := func(state *ShellyDW2State, illumination string) {
+		state.Illumination = illumination
+	}
+	return subscribeDW2Sensor(ctx, s, "illumination", StringCodec, apply, illuminationHandler)
+}
+
+func (s ShellyDW2) SubscribeTemperature(temperatureHandler func(float32)) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeTemperatureCtx(ctx, temperatureHandler)
+}
+
+// SubscribeTemperatureCtx reports the temperature in the units configured
+// on the device.
+func (s ShellyDW2) SubscribeTemperatureCtx(
+	ctx context.Context,
+	temperatureHandler func(float32),
+) (*Subscription, error) {
+	apply := func(state *ShellyDW2State, temperature float32) { state.Temperature = temperature }
+	return subscribeDW2Sensor(ctx, s, "temperature", Float32Codec, apply, temperatureHandler)
+}
+
+func (s ShellyDW2) SubscribeBattery(batteryHandler func(float32)) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeBatteryCtx(ctx, batteryHandler)
+}
+
+// SubscribeBatteryCtx reports the battery level in percent.
+func (s ShellyDW2) SubscribeBatteryCtx(
+	ctx context.Context,
+	batteryHandler func(float32),
+) (*Subscription, error) {
+	apply := func(state *ShellyDW2State, battery float32) { state.Battery = battery }
+	return subscribeDW2Sensor(ctx, s, "battery", Float32Codec, apply, batteryHandler)
+}
+
+func (s ShellyDW2) SubscribeSensorError(errorHandler func(int)) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeSensorErrorCtx(ctx, errorHandler)
+}
+
+// SubscribeSensorErrorCtx reports the sensor error code, 0 if the sensors
+// work.
+func (s ShellyDW2) SubscribeSensorErrorCtx(
+	ctx context.Context,
+	errorHandler func(int),
+) (*Subscription, error) {
+	apply := func(state *ShellyDW2State, sensorError int) { state.SensorError = sensorError }
+	return subscribeDW2Sensor(ctx, s, "error", IntCodec, apply, errorHandler)
+}
+
+type ShellyDW2WakeUpCallback = func(wakeUp ShellyDW2WakeUp)
+
+func (s ShellyDW2) SubscribeWakeUp(wakeUpCallback ShellyDW2WakeUpCallback) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeWakeUpCtx(ctx, wakeUpCallback)
+}
+
+// SubscribeWakeUpCtx calls wakeUpCallback for every info message that lists
+// reasons for waking up. The DW2 publishes one each time it wakes.
+func (s ShellyDW2) SubscribeWakeUpCtx(
+	ctx context.Context,
+	wakeUpCallback ShellyDW2WakeUpCallback,
+) (*Subscription, error) {
+	return s.SubscribeInfoCtx(ctx, func(info ShellyDW2Info) {
+		if len(info.ActReasons) == 0 || wakeUpCallback == nil {
+			return
+		}
+		wakeUpCallback(ShellyDW2WakeUp{Reasons: info.ActReasons, Info: info, Time: time.Now()})
+	})
+}
+
+func (s ShellyDW2) State() ShellyDW2State {
+	return s.state.get()
+}
+
+// LastInfo returns the last received info and when it was received.
+func (s ShellyDW2) LastInfo() (ShellyDW2Info, time.Time) {
+	state := s.state.get()
+	return state.Info, state.InfoUpdated
+}
+
+func (s ShellyDW2) TrackState() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.TrackStateCtx(ctx)
+}
+
+// TrackStateCtx subscribes to the topics backing State without registering
+// any callbacks. Calling it again is a no-op.
+func (s ShellyDW2) TrackStateCtx(ctx context.Context) error {
+	return s.state.track(func() error {
+		_, err := subscribeAll(ctx, []func() (*Subscription, error){
+			func() (*Subscription, error) { return s.SubscribeOpenStateCtx(ctx, nil, nil) },
+			func() (*Subscription, error) { return s.SubscribeTiltCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeVibrationCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeLuxCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeIlluminationCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeTemperatureCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeBatteryCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeSensorErrorCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeInfoCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeWindowPositionCtx(ctx, nil) },
+		})
+		return err
+	})
+}
+
+// OpenStateEvents streams open and close events until ctx is done, then
+// closes the channel.
+func (s ShellyDW2) OpenStateEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan OpenStateReading, error) {
+	subscribe := func(ctx context.Context, send func(OpenStateReading)) (*Subscription, error) {
+		return s.SubscribeOpenStateCtx(ctx, func() {
+			send(OpenStateReading{Open: true, Time: time.Now()})
+		}, func() {
+			send(OpenStateReading{Open: false, Time: time.Now()})
+		})
+	}
+	return openStream(ctx, s.logger, opts, subscribe)
+}
+
+// InfoEvents streams info messages until ctx is done, then closes the
+// channel.
+func (s ShellyDW2) InfoEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan ShellyDW2Info, error) {
+	return openStream(ctx, s.logger, opts, s.SubscribeInfoCtx)
+}
+
+// WakeUpEvents streams wake-ups until ctx is done, then closes the channel.
+func (s ShellyDW2) WakeUpEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan ShellyDW2WakeUp, error) {
+	return openStream(ctx, s.logger, opts, s.SubscribeWakeUpCtx)
 }
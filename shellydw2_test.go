@@ -0,0 +1,152 @@
+package shelly
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShellyDW2OpenStateCallbacks(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	dw2 := conn.NewShellyDW2("C92B94")
+
+	events := make(chan string, 2)
+	_, err := dw2.SubscribeOpenState(func() { events <- "open" }, func() { events <- "close" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "open")
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "close")
+	got := []string{receive(t, events), receive(t, events)}
+	if got[0] != "open" || got[1] != "close" {
+		t.Errorf("got %v, want [open close]", got)
+	}
+}
+
+func TestShellyDW2WakeUp(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	dw2 := conn.NewShellyDW2("C92B94")
+
+	wakeUps := make(chan ShellyDW2WakeUp, 1)
+	_, err := dw2.SubscribeWakeUp(func(wakeUp ShellyDW2WakeUp) { wakeUps <- wakeUp })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Info messages without act_reasons are not wake-ups.
+	broker.Publish("shellies/shellydw2-C92B94/info", `{"accel": {"tilt": 0}}`)
+	broker.Publish(
+		"shellies/shellydw2-C92B94/info",
+		`{"accel": {"tilt": 90}, "act_reasons": ["sensor", "periodic"]}`,
+	)
+	wakeUp := receive(t, wakeUps)
+	if !wakeUp.HasReason(WakeReasonSensor) || !wakeUp.HasReason(WakeReasonPeriodic) ||
+		wakeUp.HasReason(WakeReasonButton) {
+		t.Errorf("unexpected reasons %v", wakeUp.Reasons)
+	}
+	if wakeUp.Info.Accel.Tilt != 90 {
+		t.Errorf("got tilt %d, want 90", wakeUp.Info.Accel.Tilt)
+	}
+}
+
+func TestShellyDW2WindowPosition(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	dw2 := conn.NewShellyDW2(
+		"C92B94", WithWindowCalibration(WindowCalibration{TiltedAngle: 8, Hysteresis: 1}),
+	)
+
+	positions := make(chan WindowPosition, 4)
+	_, err := dw2.SubscribeWindowPosition(func(p WindowPosition) { positions <- p })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Publish("shellies/shellydw2-C92B94/sensor/tilt", "8")
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "open")
+	// An unchanged position is not reported again.
+	broker.Publish("shellies/shellydw2-C92B94/sensor/tilt", "7")
+	broker.Publish(
+		"shellies/shellydw2-C92B94/info",
+		`{"sensor": {"state": "open", "is_valid": true}, "accel": {"tilt": 0}}`,
+	)
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "close")
+
+	for _, want := range []WindowPosition{WindowTilted, WindowOpen, WindowClosed} {
+		if got := receive(t, positions); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if got := dw2.State().Window; got != WindowClosed {
+		t.Errorf("got state %v, want closed", got)
+	}
+}
+
+func TestShellyDW2WindowPositionMessageOrder(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	dw2 := conn.NewShellyDW2("C92B94")
+
+	// Every subscription classifies on its own, so a second one must not
+	// change what the first reports.
+	var subscribers [2]chan WindowPosition
+	for i := range subscribers {
+		positions := make(chan WindowPosition, 8)
+		subscribers[i] = positions
+		_, err := dw2.SubscribeWindowPosition(func(p WindowPosition) { positions <- p })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The DW2 publishes sensor/state before sensor/tilt.
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "close")
+	broker.Publish("shellies/shellydw2-C92B94/sensor/tilt", "0")
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "open")
+	broker.Publish("shellies/shellydw2-C92B94/sensor/tilt", "12")
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "open")
+	broker.Publish("shellies/shellydw2-C92B94/sensor/tilt", "0")
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "close")
+	// Without a tilt, an open window is classified after the settle time.
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "open")
+
+	want := []WindowPosition{WindowClosed, WindowTilted, WindowOpen, WindowClosed, WindowOpen}
+	for i, positions := range subscribers {
+		for _, want := range want {
+			if got := receive(t, positions); got != want {
+				t.Errorf("subscriber %d: got %v, want %v", i, got, want)
+			}
+		}
+	}
+	if got := dw2.WindowPosition(); got != WindowOpen {
+		t.Errorf("got position %v, want open", got)
+	}
+}
+
+func TestShellyDW2WindowPositionSettlePanic(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	dw2 := conn.NewShellyDW2("C92B94")
+	panics := make(chan string, 1)
+	conn.OnCallbackPanic(func(deviceName string, topic string, recovered interface{}) {
+		panics <- topic
+	})
+
+	_, err := dw2.SubscribeWindowPosition(func(p WindowPosition) {
+		if p == WindowOpen {
+			panic("boom")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With no tilt following, the open state settles on the dispatcher,
+	// which recovers from the panic.
+	broker.Publish("shellies/shellydw2-C92B94/sensor/state", "open")
+	select {
+	case topic := <-panics:
+		if topic != "shellies/shellydw2-C92B94/sensor/state" {
+			t.Errorf("got panic on %s", topic)
+		}
+	case <-time.After(2 * windowSettleTime):
+		t.Fatal("timed out waiting for the recovered panic")
+	}
+}
@@ -1,83 +1,327 @@
 package shelly
 
 import (
-	"fmt"
-	"strconv"
+	"context"
+	"sync"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/rs/zerolog/log"
 )
 
+const shellyPlugSDeviceType = "shellyplug-s"
+
 type ShellyPlugS struct {
-	ShellyDevice
+	*ShellyDevice
+	state *shadow[ShellyPlugSState]
 }
 
-func NewShellyPlugS(deviceId string, mqttOpts *MQTT.ClientOptions) ShellyPlugS {
-	client := MQTT.NewClient(mqttOpts)
-	s := ShellyPlugS{ShellyDevice{DeviceId: deviceId, mqttClient: client, mqttOpts: mqttOpts}}
-	log.Debug().Str("DeviceName", s.DeviceName()).Msg("New ShellyPlugS")
-	return s
+// ShellyPlugSState is the last known state of a ShellyPlugS. Zero timestamps
+// mean nothing was received yet. Energy is the counter of the plug in Wh,
+// which restarts at zero when the plug reboots, while EnergyTotal adds up
+// the consumption since TrackState across such resets.
+type ShellyPlugSState struct {
+	RelayOn                bool
+	RelayUpdated           time.Time
+	Power                  float32
+	PowerUpdated           time.Time
+	Energy                 float64
+	EnergyTotal            float64
+	EnergyUpdated          time.Time
+	Temperature            float32
+	TemperatureF           float32
+	TemperatureUpdated     time.Time
+	Overtemperature        bool
+	OvertemperatureUpdated time.Time
 }
 
-func (s ShellyPlugS) Connect() {
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Error().
-			Str("DeviceName", s.DeviceName()).
-			Err(token.Error()).
-			Msg("Error connecting to MQTT!")
-	}
-	log.Info().Str("DeviceName", s.DeviceName()).Msg("connected")
+// ShellyPlugSEnergy is an energy reading of a ShellyPlugS, in Wh.
+type ShellyPlugSEnergy struct {
+	// Counter is the energy counter of the plug.
+	Counter float64
+	// Delta is the consumption since the previous reading, 0 for the first
+	// reading of a subscription.
+	Delta float64
+	// Total adds up Delta since the subscription started.
+	Total float64
+	// Reset is set when the counter went backwards, e.g. after a reboot.
+	// Delta is then the counter itself, i.e. the consumption since the
+	// reset.
+	Reset bool
+}
+
+var (
+	// energyCodec decodes relay/0/energy, which is in watt-minutes, to Wh.
+	energyCodec Codec[float64] = CodecFunc[float64](func(payload []byte) (float64, error) {
+		wattMinutes, err := Float64Codec.Decode(payload)
+		return wattMinutes / 60, err
+	})
+
+	// overtemperatureCodec decodes overtemperature, 1 if the plug switched
+	// off because it overheated and 0 otherwise.
+	overtemperatureCodec Codec[bool] = EnumCodec(map[string]bool{"1": true, "0": false})
+)
+
+// energyCounter turns energy counter readings into deltas and totals.
+type energyCounter struct {
+	mu      sync.Mutex
+	started bool
+	last    float64
+	total   float64
 }
 
-func (s ShellyPlugS) Close() {
-	s.mqttClient.Disconnect(disconnectQiesceTimeMs)
-	log.Info().Str("DeviceName", s.DeviceName()).Msg("disconnected")
+func (c *energyCounter) update(counter float64) ShellyPlugSEnergy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	energy := ShellyPlugSEnergy{Counter: counter}
+	switch {
+	case !c.started:
+		c.started = true
+	case counter < c.last:
+		energy.Reset = true
+		energy.Delta = counter
+	default:
+		energy.Delta = counter - c.last
+	}
+	c.last = counter
+	c.total += energy.Delta
+	energy.Total = c.total
+	return energy
 }
 
-func (s ShellyPlugS) DeviceName() string {
-	return fmt.Sprintf("shellyplug-s-%s", s.DeviceId)
+func NewShellyPlugS(
+	deviceId string,
+	mqttOpts *MQTT.ClientOptions,
+	opts ...DeviceOption,
+) ShellyPlugS {
+	connectionOptions := newDeviceConfig(opts).connectionOptions
+	return NewConnectionManager(mqttOpts, connectionOptions...).NewShellyPlugS(deviceId, opts...)
 }
 
-func (s ShellyPlugS) baseTopic() string {
-	return fmt.Sprintf("shellies/%s", s.DeviceName())
+// PlugSDeviceName returns the name a ShellyPlugS created with the same
+// arguments uses in its topics, without creating the device.
+func PlugSDeviceName(deviceId string, opts ...DeviceOption) string {
+	return deviceName(shellyPlugSDeviceType, deviceId, newDeviceConfig(opts))
 }
 
 func (s ShellyPlugS) baseCommandTopic() string {
 	return s.baseTopic() + "/relay/0/command"
 }
 
-func (s ShellyPlugS) SubscribeRelayState(onHandler func(), offHandler func()) {
+func (s ShellyPlugS) SubscribeRelayState(
+	onHandler func(),
+	offHandler func(),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeRelayStateCtx(ctx, onHandler, offHandler)
+}
+
+func (s ShellyPlugS) SubscribeRelayStateCtx(
+	ctx context.Context,
+	onHandler func(),
+	offHandler func(),
+) (*Subscription, error) {
 	topic := s.baseTopic() + "/relay/0"
-	relayStateCallback := func(relayState string) {
-		if relayState == "on" {
+	relayStateCallback := func(on bool) {
+		s.state.update(func(state *ShellyPlugSState) {
+			state.RelayOn = on
+			state.RelayUpdated = time.Now()
+		})
+
+		if on && onHandler != nil {
 			onHandler()
-		} else if relayState == "off" {
+		} else if !on && offHandler != nil {
 			offHandler()
-		} else {
-			log.Error().Str("relayState", relayState).Msg("received unknown relayState value")
 		}
 	}
 
-	SubscribeStringHelper(s.mqttClient, topic, relayStateCallback)
+	return s.subscribe(ctx, topic, decodingHandler(s.logger, OnOffCodec, relayStateCallback))
+}
+
+func (s ShellyPlugS) SubscribePower(powerHandler func(float32)) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribePowerCtx(ctx, powerHandler)
 }
 
-func (s ShellyPlugS) SubscribePower(powerHandler func(float32)) {
+func (s ShellyPlugS) SubscribePowerCtx(
+	ctx context.Context,
+	powerHandler func(float32),
+) (*Subscription, error) {
 	topic := s.baseTopic() + "/relay/0/power"
-	powerCallback := func(powerStr string) {
-		power, err := strconv.ParseFloat(powerStr, 32)
-		if err != nil {
-			log.Error().Str("powerStr", powerStr).Msg("error parsing powerStr as float32")
+	powerCallback := func(power float32) {
+		s.state.update(func(state *ShellyPlugSState) {
+			state.Power = power
+			state.PowerUpdated = time.Now()
+		})
+		if powerHandler != nil {
+			powerHandler(power)
+		}
+	}
+
+	return s.subscribe(ctx, topic, decodingHandler(s.logger, Float32Codec, powerCallback))
+}
+
+func (s ShellyPlugS) SubscribeEnergy(
+	energyHandler func(ShellyPlugSEnergy),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeEnergyCtx(ctx, energyHandler)
+}
+
+// SubscribeEnergyCtx reports the energy counter converted to Wh, along with
+// the consumption since the previous reading, detecting counter resets.
+func (s ShellyPlugS) SubscribeEnergyCtx(
+	ctx context.Context,
+	energyHandler func(ShellyPlugSEnergy),
+) (*Subscription, error) {
+	return s.subscribeEnergyCtx(ctx, false, energyHandler)
+}
+
+// subscribeEnergyCtx keeps a counter per subscription, since every
+// subscription sees each reading. Only the one of TrackState maintains
+// EnergyTotal.
+func (s ShellyPlugS) subscribeEnergyCtx(
+	ctx context.Context,
+	trackTotal bool,
+	energyHandler func(ShellyPlugSEnergy),
+) (*Subscription, error) {
+	topic := s.baseTopic() + "/relay/0/energy"
+	var counter energyCounter
+	energyCallback := func(wh float64) {
+		energy := counter.update(wh)
+		s.state.update(func(state *ShellyPlugSState) {
+			state.Energy = energy.Counter
+			if trackTotal {
+				state.EnergyTotal = energy.Total
+			}
+			state.EnergyUpdated = time.Now()
+		})
+		if energyHandler != nil {
+			energyHandler(energy)
+		}
+	}
+
+	return s.subscribe(ctx, topic, decodingHandler(s.logger, energyCodec, energyCallback))
+}
+
+func (s ShellyPlugS) SubscribeTemperature(
+	temperatureHandler func(float32),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeTemperatureCtx(ctx, temperatureHandler)
+}
+
+// SubscribeTemperatureCtx reports the internal temperature of the plug in
+// °C.
+func (s ShellyPlugS) SubscribeTemperatureCtx(
+	ctx context.Context,
+	temperatureHandler func(float32),
+) (*Subscription, error) {
+	topic := s.baseTopic() + "/temperature"
+	temperatureCallback := func(temperature float32) {
+		s.state.update(func(state *ShellyPlugSState) {
+			state.Temperature = temperature
+			state.TemperatureUpdated = time.Now()
+		})
+		if temperatureHandler != nil {
+			temperatureHandler(temperature)
 		}
-		powerHandler(float32(power))
 	}
 
-	SubscribeStringHelper(s.mqttClient, topic, powerCallback)
+	return s.subscribe(ctx, topic, decodingHandler(s.logger, Float32Codec, temperatureCallback))
+}
+
+func (s ShellyPlugS) SubscribeTemperatureF(
+	temperatureHandler func(float32),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeTemperatureFCtx(ctx, temperatureHandler)
+}
+
+// SubscribeTemperatureFCtx reports the internal temperature of the plug in
+// °F.
+func (s ShellyPlugS) SubscribeTemperatureFCtx(
+	ctx context.Context,
+	temperatureHandler func(float32),
+) (*Subscription, error) {
+	topic := s.baseTopic() + "/temperature_f"
+	temperatureCallback := func(temperature float32) {
+		s.state.update(func(state *ShellyPlugSState) {
+			state.TemperatureF = temperature
+			state.TemperatureUpdated = time.Now()
+		})
+		if temperatureHandler != nil {
+			temperatureHandler(temperature)
+		}
+	}
+
+	return s.subscribe(ctx, topic, decodingHandler(s.logger, Float32Codec, temperatureCallback))
+}
+
+func (s ShellyPlugS) SubscribeOvertemperature(
+	overtemperatureHandler func(bool),
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeOvertemperatureCtx(ctx, overtemperatureHandler)
 }
 
-func (s ShellyPlugS) switchRelay(relayState bool) {
-	log.Info().
-		Str("DeviceName", s.DeviceName()).
-		Msg("switching on")
+// SubscribeOvertemperatureCtx reports whether the plug switched off because
+// it overheated.
+func (s ShellyPlugS) SubscribeOvertemperatureCtx(
+	ctx context.Context,
+	overtemperatureHandler func(bool),
+) (*Subscription, error) {
+	topic := s.baseTopic() + "/overtemperature"
+	overtemperatureCallback := func(overtemperature bool) {
+		s.state.update(func(state *ShellyPlugSState) {
+			state.Overtemperature = overtemperature
+			state.OvertemperatureUpdated = time.Now()
+		})
+		if overtemperatureHandler != nil {
+			overtemperatureHandler(overtemperature)
+		}
+	}
+
+	return s.subscribe(
+		ctx, topic, decodingHandler(s.logger, overtemperatureCodec, overtemperatureCallback),
+	)
+}
+
+func (s ShellyPlugS) State() ShellyPlugSState {
+	return s.state.get()
+}
+
+func (s ShellyPlugS) TrackState() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.TrackStateCtx(ctx)
+}
+
+// TrackStateCtx subscribes to the topics backing State without registering
+// any callbacks. Calling it again is a no-op.
+func (s ShellyPlugS) TrackStateCtx(ctx context.Context) error {
+	return s.state.track(func() error {
+		_, err := subscribeAll(ctx, []func() (*Subscription, error){
+			func() (*Subscription, error) { return s.SubscribeRelayStateCtx(ctx, nil, nil) },
+			func() (*Subscription, error) { return s.SubscribePowerCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.subscribeEnergyCtx(ctx, true, nil) },
+			func() (*Subscription, error) { return s.SubscribeTemperatureCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeTemperatureFCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeOvertemperatureCtx(ctx, nil) },
+		})
+		return err
+	})
+}
+
+func (s ShellyPlugS) switchRelayCtx(ctx context.Context, relayState bool) error {
+	s.logger.Info().
+		Bool("relayState", relayState).
+		Msg("switching relay")
 	topic := s.baseCommandTopic()
 
 	command := "off"
@@ -85,15 +329,107 @@ func (s ShellyPlugS) switchRelay(relayState bool) {
 		command = "on"
 	}
 
-	token := s.mqttClient.Publish(topic, byte(qos), false, command)
-	token.Wait()
+	return s.publish(ctx, topic, command)
 }
 
-func (s ShellyPlugS) SwitchOn() {
-	s.switchRelay(true)
+func (s ShellyPlugS) SwitchOn() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SwitchOnCtx(ctx)
+}
 
+func (s ShellyPlugS) SwitchOnCtx(ctx context.Context) error {
+	return s.switchRelayCtx(ctx, true)
 }
 
-func (s ShellyPlugS) SwitchOff() {
-	s.switchRelay(false)
+func (s ShellyPlugS) SwitchOff() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SwitchOffCtx(ctx)
+}
+
+func (s ShellyPlugS) SwitchOffCtx(ctx context.Context) error {
+	return s.switchRelayCtx(ctx, false)
+}
+
+func (s ShellyPlugS) SwitchOnConfirmed() error {
+	ctx, cancel := confirmContext()
+	defer cancel()
+	return s.SwitchOnConfirmedCtx(ctx)
+}
+
+// SwitchOnConfirmedCtx switches the relay on and waits until the plug
+// reports it as on.
+func (s ShellyPlugS) SwitchOnConfirmedCtx(ctx context.Context) error {
+	return s.switchRelayConfirmedCtx(ctx, true)
+}
+
+func (s ShellyPlugS) SwitchOffConfirmed() error {
+	ctx, cancel := confirmContext()
+	defer cancel()
+	return s.SwitchOffConfirmedCtx(ctx)
+}
+
+// SwitchOffConfirmedCtx switches the relay off and waits until the plug
+// reports it as off.
+func (s ShellyPlugS) SwitchOffConfirmedCtx(ctx context.Context) error {
+	return s.switchRelayConfirmedCtx(ctx, false)
+}
+
+func (s ShellyPlugS) switchRelayConfirmedCtx(ctx context.Context, relayState bool) error {
+	if err := s.TrackStateCtx(ctx); err != nil {
+		return err
+	}
+
+	since := time.Now()
+	if err := s.switchRelayCtx(ctx, relayState); err != nil {
+		return err
+	}
+
+	state, err := s.state.wait(ctx, func(state ShellyPlugSState) bool {
+		return state.RelayUpdated.After(since) && state.RelayOn == relayState
+	})
+	if err != nil {
+		notConfirmed := &NotConfirmedError{
+			DeviceName: s.DeviceName(),
+			Field:      "relay",
+			Want:       relayState,
+			Err:        waitErr(err),
+		}
+		if state.RelayUpdated.After(since) {
+			notConfirmed.Got = state.RelayOn
+		}
+		return notConfirmed
+	}
+	return nil
+}
+
+// PowerEvents streams power readings until ctx is done, then closes the
+// channel.
+func (s ShellyPlugS) PowerEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan PowerReading, error) {
+	subscribe := func(ctx context.Context, send func(PowerReading)) (*Subscription, error) {
+		return s.SubscribePowerCtx(ctx, func(power float32) {
+			send(PowerReading{Power: power, Time: time.Now()})
+		})
+	}
+	return openStream(ctx, s.logger, opts, subscribe)
+}
+
+// RelayEvents streams relay state changes until ctx is done, then closes the
+// channel.
+func (s ShellyPlugS) RelayEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan RelayReading, error) {
+	subscribe := func(ctx context.Context, send func(RelayReading)) (*Subscription, error) {
+		return s.SubscribeRelayStateCtx(ctx, func() {
+			send(RelayReading{On: true, Time: time.Now()})
+		}, func() {
+			send(RelayReading{On: false, Time: time.Now()})
+		})
+	}
+	return openStream(ctx, s.logger, opts, subscribe)
 }
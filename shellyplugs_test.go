@@ -0,0 +1,187 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/washed/shelly-go/capture"
+	"github.com/washed/shelly-go/shellytest"
+)
+
+func TestShellyPlugSEnergy(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	plugS := conn.NewShellyPlugS("EF6948")
+	if err := plugS.TrackState(); err != nil {
+		t.Fatal(err)
+	}
+	readings := make(chan ShellyPlugSEnergy, 4)
+	if _, err := plugS.SubscribeEnergy(func(e ShellyPlugSEnergy) { readings <- e }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Watt-minutes: 100 Wh, 130 Wh, a reboot, then 12 Wh since the reboot.
+	for _, payload := range []string{"6000", "7800", "0", "720"} {
+		broker.Publish("shellies/shellyplug-s-EF6948/relay/0/energy", payload)
+	}
+	want := []ShellyPlugSEnergy{
+		{Counter: 100},
+		{Counter: 130, Delta: 30, Total: 30},
+		{Counter: 0, Total: 30, Reset: true},
+		{Counter: 12, Delta: 12, Total: 42},
+	}
+	for _, w := range want {
+		if got := receive(t, readings); got != w {
+			t.Errorf("got %+v, want %+v", got, w)
+		}
+	}
+	if state := plugS.State(); state.Energy != 12 || state.EnergyTotal != 42 {
+		t.Errorf("got energy %v and total %v, want 12 and 42", state.Energy, state.EnergyTotal)
+	}
+}
+
+func TestShellyPlugSCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []DeviceOption
+		command func(s ShellyPlugS) error
+		want    shellytest.Publication
+	}{
+		{
+			name:    "on",
+			command: ShellyPlugS.SwitchOn,
+			want: shellytest.Publication{
+				Topic:   "shellies/shellyplug-s-EF6948/relay/0/command",
+				Payload: []byte("on"),
+			},
+		},
+		{
+			name:    "off",
+			command: ShellyPlugS.SwitchOff,
+			want: shellytest.Publication{
+				Topic:   "shellies/shellyplug-s-EF6948/relay/0/command",
+				Payload: []byte("off"),
+			},
+		},
+		{
+			name: "options",
+			opts: []DeviceOption{
+				WithTopicPrefix("home"),
+				WithDeviceName("kitchen"),
+				WithPublishQoS(1),
+				WithRetain(true),
+			},
+			command: ShellyPlugS.SwitchOn,
+			want: shellytest.Publication{
+				Topic:    "home/kitchen/relay/0/command",
+				Payload:  []byte("on"),
+				QoS:      1,
+				Retained: true,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, broker := newTestConnection(t)
+			plugS := conn.NewShellyPlugS("EF6948", test.opts...)
+			if err := test.command(plugS); err != nil {
+				t.Fatal(err)
+			}
+			checkPublished(t, broker, test.want)
+		})
+	}
+}
+
+func TestShellyPlugSSwitchConfirmed(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	plugS := conn.NewShellyPlugS("EF6948")
+	broker.OnPublish("shellies/+/relay/0/command", func(p shellytest.Publication) {
+		broker.Publish("shellies/shellyplug-s-EF6948/relay/0", p.Payload)
+	})
+
+	if err := plugS.SwitchOnConfirmedCtx(testContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if !plugS.State().RelayOn {
+		t.Error("relay should be on")
+	}
+}
+
+func TestShellyPlugSSwitchNotConfirmed(t *testing.T) {
+	conn, _ := newTestConnection(t)
+	plugS := conn.NewShellyPlugS("EF6948")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := plugS.SwitchOnConfirmedCtx(ctx)
+	if !errors.Is(err, ErrNotConfirmed) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want a timed out NotConfirmedError", err)
+	}
+}
+
+func TestShellyPlugSReplay(t *testing.T) {
+	f, err := os.Open("testdata/shellyplug-s-session.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := capture.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, broker := newTestConnection(t)
+	plugS := conn.NewShellyPlugS("EF6948")
+	if err := plugS.TrackState(); err != nil {
+		t.Fatal(err)
+	}
+	powers := make(chan float32, len(records))
+	if _, err := plugS.SubscribePower(func(power float32) { powers <- power }); err != nil {
+		t.Fatal(err)
+	}
+
+	err = capture.Replay(context.Background(), records, 0, func(r capture.Record) error {
+		broker.Publish(r.Topic, r.Payload)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []float32{58.73, 61.02, 0} {
+		if got := receive(t, powers); got != want {
+			t.Errorf("got power %v, want %v", got, want)
+		}
+	}
+	// Messages of a device are delivered in order, so the relay state was
+	// handled before the last power reading.
+	if state := plugS.State(); state.RelayOn || state.RelayUpdated.IsZero() {
+		t.Errorf("relay should be off at the end of the session: %+v", state)
+	}
+}
+
+// checkPublished fails the test unless want is the last message published
+// on its topic.
+func checkPublished(t *testing.T, broker *shellytest.Broker, want shellytest.Publication) {
+	t.Helper()
+	got, ok := broker.LastPublished(want.Topic)
+	if !ok {
+		t.Fatalf("nothing published on %s, got %v", want.Topic, broker.Published())
+	}
+	if string(got.Payload) != string(want.Payload) || got.QoS != want.QoS ||
+		got.Retained != want.Retained {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPlugSDeviceName(t *testing.T) {
+	conn, _ := newTestConnection(t)
+	for _, opts := range [][]DeviceOption{nil, {WithDeviceName("kitchen")}} {
+		want := conn.NewShellyPlugS("EF6948", opts...).DeviceName()
+		if got := PlugSDeviceName("EF6948", opts...); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Package shellytest provides an in-process MQTT broker for testing code
+// built on the shelly package without a real broker.
+//
+// Clients created by a Broker implement MQTT.Client. Messages published by
+// one client are delivered to the subscriptions of every connected client,
+// synchronously and in the publishing goroutine. Tests play the role of the
+// devices by publishing with Broker.Publish and inspect commands with
+// Broker.Published.
+package shellytest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ErrConnectionLost is passed to the connection lost handlers of clients
+// disconnected with Broker.DropConnections.
+var ErrConnectionLost = errors.New("shellytest: connection lost")
+
+// Publication is a message published on the broker.
+type Publication struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+}
+
+// String returns the payload as a string.
+func (p Publication) String() string {
+	return string(p.Payload)
+}
+
+type publishHook struct {
+	filter  string
+	handler func(Publication)
+}
+
+// Broker routes messages between the clients it created.
+type Broker struct {
+	mu        sync.Mutex
+	clients   []*Client
+	published []Publication
+	retained  map[string]Publication
+	hooks     []publishHook
+}
+
+func NewBroker() *Broker {
+	return &Broker{retained: map[string]Publication{}}
+}
+
+// NewClient returns a client bound to the broker. It has the signature of a
+// client factory, so it can replace MQTT.NewClient.
+func (b *Broker) NewClient(opts *MQTT.ClientOptions) MQTT.Client {
+	c := &Client{broker: b, opts: opts, routes: map[string]MQTT.MessageHandler{}}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clients = append(b.clients, c)
+	return c
+}
+
+// Publish delivers a message to every subscribed client, as if a device had
+// published it.
+func (b *Broker) Publish(topic string, payload interface{}) {
+	b.publish(Publication{Topic: topic, Payload: toBytes(payload)}, false)
+}
+
+// PublishRetained is like Publish, but the broker also keeps the message for
+// later subscribers.
+func (b *Broker) PublishRetained(topic string, payload interface{}) {
+	b.publish(Publication{Topic: topic, Payload: toBytes(payload), Retained: true}, false)
+}
+
+// Published returns every message published by the clients, oldest first.
+func (b *Broker) Published() []Publication {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Publication{}, b.published...)
+}
+
+// LastPublished returns the last message a client published on topic.
+func (b *Broker) LastPublished(topic string) (Publication, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.published) - 1; i >= 0; i-- {
+		if b.published[i].Topic == topic {
+			return b.published[i], true
+		}
+	}
+	return Publication{}, false
+}
+
+// Reset forgets the messages published so far.
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = nil
+}
+
+// OnPublish calls handler for every message a client publishes on a topic
+// matching filter, before it is delivered to subscribers. Handlers may
+// publish themselves, e.g. to answer commands like a device would.
+func (b *Broker) OnPublish(filter string, handler func(Publication)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = append(b.hooks, publishHook{filter: filter, handler: handler})
+}
+
+// Subscribed reports whether any connected client subscribed to filter.
+func (b *Broker) Subscribed(filter string) bool {
+	for _, c := range b.connectedClients() {
+		c.mu.Lock()
+		_, ok := c.routes[filter]
+		c.mu.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DropConnections disconnects every client as if the network failed. The
+// clients forget their subscriptions, like with a clean session, and their
+// connection lost handlers are called.
+func (b *Broker) DropConnections() {
+	for _, c := range b.connectedClients() {
+		c.mu.Lock()
+		c.connected = false
+		c.routes = map[string]MQTT.MessageHandler{}
+		c.mu.Unlock()
+		if c.opts.OnConnectionLost != nil {
+			c.opts.OnConnectionLost(c, ErrConnectionLost)
+		}
+	}
+}
+
+// Reconnect connects every client dropped by DropConnections again and
+// calls their connect handlers.
+func (b *Broker) Reconnect() {
+	b.mu.Lock()
+	clients := append([]*Client{}, b.clients...)
+	b.mu.Unlock()
+
+	for _, c := range clients {
+		c.mu.Lock()
+		reconnect := c.started && !c.connected
+		c.connected = c.connected || reconnect
+		c.mu.Unlock()
+		if reconnect && c.opts.OnConnect != nil {
+			c.opts.OnConnect(c)
+		}
+	}
+}
+
+func (b *Broker) connectedClients() []*Client {
+	b.mu.Lock()
+	clients := append([]*Client{}, b.clients...)
+	b.mu.Unlock()
+
+	connected := clients[:0]
+	for _, c := range clients {
+		if c.IsConnected() {
+			connected = append(connected, c)
+		}
+	}
+	return connected
+}
+
+// publish records messages from clients, runs the hooks and delivers the
+// message to every matching subscription.
+func (b *Broker) publish(p Publication, fromClient bool) {
+	b.mu.Lock()
+	if fromClient {
+		b.published = append(b.published, p)
+	}
+	if p.Retained {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.Topic)
+		} else {
+			b.retained[p.Topic] = p
+		}
+	}
+	var hooks []publishHook
+	if fromClient {
+		for _, hook := range b.hooks {
+			if Match(hook.filter, p.Topic) {
+				hooks = append(hooks, hook)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook.handler(p)
+	}
+	for _, c := range b.connectedClients() {
+		c.deliver(p)
+	}
+}
+
+// retainedFor returns the retained messages matching filter.
+func (b *Broker) retainedFor(filter string) []Publication {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var matching []Publication
+	for topic, p := range b.retained {
+		if Match(filter, topic) {
+			matching = append(matching, p)
+		}
+	}
+	return matching
+}
+
+// Match reports whether topic matches the MQTT topic filter, which may
+// contain the wildcards + and #.
+func Match(filter string, topic string) bool {
+	for {
+		level, filterRest, filterMore := strings.Cut(filter, "/")
+		if level == "#" {
+			return true
+		}
+		topicLevel, topicRest, topicMore := strings.Cut(topic, "/")
+		if level != "+" && level != topicLevel {
+			return false
+		}
+		if !filterMore || !topicMore {
+			// "a/#" also matches "a".
+			return filterMore == topicMore || filterRest == "#"
+		}
+		filter, topic = filterRest, topicRest
+	}
+}
+
+func toBytes(payload interface{}) []byte {
+	switch p := payload.(type) {
+	case []byte:
+		return p
+	case string:
+		return []byte(p)
+	case bytes.Buffer:
+		return p.Bytes()
+	case *bytes.Buffer:
+		return p.Bytes()
+	default:
+		return []byte(fmt.Sprint(p))
+	}
+}
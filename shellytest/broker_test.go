@@ -0,0 +1,47 @@
+package shellytest
+
+import (
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"+/b", "a/b", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, test := range tests {
+		if got := Match(test.filter, test.topic); got != test.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestBrokerRetained(t *testing.T) {
+	broker := NewBroker()
+	client := broker.NewClient(MQTT.NewClientOptions())
+	client.Connect()
+
+	broker.PublishRetained("shellies/x/online", "true")
+	var got []string
+	client.Subscribe("shellies/+/online", 0, func(_ MQTT.Client, message MQTT.Message) {
+		got = append(got, string(message.Payload()))
+	})
+	broker.Publish("shellies/x/online", "false")
+
+	if len(got) != 2 || got[0] != "true" || got[1] != "false" {
+		t.Errorf("got %v, want [true false]", got)
+	}
+}
@@ -0,0 +1,183 @@
+package shellytest
+
+import (
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Client is an MQTT.Client connected to a Broker.
+type Client struct {
+	broker *Broker
+	opts   *MQTT.ClientOptions
+
+	mu        sync.Mutex
+	connected bool
+	started   bool
+	routes    map[string]MQTT.MessageHandler
+}
+
+var _ MQTT.Client = (*Client)(nil)
+
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *Client) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+func (c *Client) Connect() MQTT.Token {
+	c.mu.Lock()
+	c.connected = true
+	c.started = true
+	c.mu.Unlock()
+
+	if c.opts.OnConnect != nil {
+		// Paho calls the handler on its own goroutine as well.
+		go c.opts.OnConnect(c)
+	}
+	return completed(nil)
+}
+
+func (c *Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	c.started = false
+	c.routes = map[string]MQTT.MessageHandler{}
+}
+
+func (c *Client) Publish(
+	topic string,
+	qos byte,
+	retained bool,
+	payload interface{},
+) MQTT.Token {
+	if !c.IsConnected() {
+		return completed(MQTT.ErrNotConnected)
+	}
+	c.broker.publish(Publication{
+		Topic:    topic,
+		Payload:  toBytes(payload),
+		QoS:      qos,
+		Retained: retained,
+	}, true)
+	return completed(nil)
+}
+
+func (c *Client) Subscribe(
+	topic string,
+	qos byte,
+	callback MQTT.MessageHandler,
+) MQTT.Token {
+	if !c.IsConnected() {
+		return completed(MQTT.ErrNotConnected)
+	}
+	if callback == nil {
+		callback = c.opts.DefaultPublishHandler
+	}
+
+	c.mu.Lock()
+	c.routes[topic] = callback
+	c.mu.Unlock()
+
+	for _, p := range c.broker.retainedFor(topic) {
+		if callback != nil {
+			callback(c, message{p})
+		}
+	}
+	return completed(nil)
+}
+
+func (c *Client) SubscribeMultiple(
+	filters map[string]byte,
+	callback MQTT.MessageHandler,
+) MQTT.Token {
+	for topic, qos := range filters {
+		if token := c.Subscribe(topic, qos, callback); token.Error() != nil {
+			return token
+		}
+	}
+	return completed(nil)
+}
+
+func (c *Client) Unsubscribe(topics ...string) MQTT.Token {
+	if !c.IsConnected() {
+		return completed(MQTT.ErrNotConnected)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+	}
+	return completed(nil)
+}
+
+func (c *Client) AddRoute(topic string, callback MQTT.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[topic] = callback
+}
+
+func (c *Client) OptionsReader() MQTT.ClientOptionsReader {
+	// Paho offers no other way to build a reader.
+	return MQTT.NewClient(c.opts).OptionsReader()
+}
+
+// deliver calls the handler of every subscription matching p, or the default
+// handler if none has a handler of its own.
+func (c *Client) deliver(p Publication) {
+	c.mu.Lock()
+	var handlers []MQTT.MessageHandler
+	for filter, handler := range c.routes {
+		if handler != nil && Match(filter, p.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(handlers) == 0 && c.opts.DefaultPublishHandler != nil {
+		handlers = append(handlers, c.opts.DefaultPublishHandler)
+	}
+	for _, handler := range handlers {
+		handler(c, message{p})
+	}
+}
+
+// message adapts a Publication to MQTT.Message.
+type message struct {
+	p Publication
+}
+
+func (m message) Duplicate() bool   { return false }
+func (m message) Qos() byte         { return m.p.QoS }
+func (m message) Retained() bool    { return m.p.Retained }
+func (m message) Topic() string     { return m.p.Topic }
+func (m message) MessageID() uint16 { return 0 }
+func (m message) Payload() []byte   { return m.p.Payload }
+func (m message) Ack()              {}
+
+// token is an MQTT.Token that has already completed.
+type token struct {
+	err error
+}
+
+var closed = make(chan struct{})
+
+func init() {
+	close(closed)
+}
+
+func completed(err error) MQTT.Token {
+	return token{err: err}
+}
+
+func (t token) Wait() bool                     { return true }
+func (t token) WaitTimeout(time.Duration) bool { return true }
+func (t token) Done() <-chan struct{}          { return closed }
+func (t token) Error() error                   { return t.err }
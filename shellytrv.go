@@ -1,10 +1,11 @@
 package shelly
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/rs/zerolog/log"
 )
 
 func Btoi(b bool) int {
@@ -14,8 +15,31 @@ func Btoi(b bool) int {
 	return 0
 }
 
+const shellyTRVDeviceType = "shellytrv"
+
+const (
+	minTargetTemperature   = 4
+	maxTargetTemperature   = 31
+	minExternalTemperature = -40
+	maxExternalTemperature = 100
+
+	// The TRV reports target temperatures and valve positions rounded.
+	targetTemperatureTolerance = 0.05
+	valvePosTolerance          = 1
+)
+
 type ShellyTRV struct {
-	ShellyDevice
+	*ShellyDevice
+	state *shadow[ShellyTRVState]
+}
+
+// ShellyTRVState is the last known state of a ShellyTRV. Zero timestamps mean
+// nothing was received yet.
+type ShellyTRVState struct {
+	Status        ShellyTRVStatus
+	StatusUpdated time.Time
+	Info          ShellyTRVInfo
+	InfoUpdated   time.Time
 }
 
 type ShellyTRVThermostat struct {
@@ -25,15 +49,20 @@ type ShellyTRVThermostat struct {
 	BoostMinutes    int              `json:"boost_minutes"`
 	TargetT         ShellyTRVTargetT `json:"target_t"`
 	Tmp             ShellyInfoTmp    `json:"tmp"`
+	WindowOpen      bool             `json:"window_open"`
 }
 
+// ShellyTRVTargetT is the target temperature. ValueOp is the target used
+// while a window is open.
 type ShellyTRVTargetT struct {
 	Enabled bool    `json:"enabled"`
 	Value   float32 `json:"value"`
+	ValueOp float32 `json:"value_op"`
 	Units   string  `json:"units"`
 }
 
 type ShellyTRVInfo struct {
+	ShellyInfo
 	Calibrated  bool                  `json:"calibrated"`
 	Charger     bool                  `json:"charger"`
 	PsMode      int                   `json:"ps_mode"`
@@ -42,50 +71,6 @@ type ShellyTRVInfo struct {
 	Bat         ShellyInfoBat         `json:"bat"`
 }
 
-/*
-Implement the rest the remaining info fields if necessary?
-{
-    "wifi_sta": {
-        "connected": true,
-        "ssid": "wpd.wlan-2.4GHz",
-        "ip": "192.168.178.123",
-        "rssi": -33
-    },
-    "cloud": {
-        "enabled": false,
-        "connected": false
-    },
-    "mqtt": {
-        "connected": true
-    },
-    "time": "17:42",
-    "unixtime": 1673628121,
-    "serial": 0,
-    "has_update": false,
-    "mac": "60A423DAE8DE",
-    "cfg_changed_cnt": 0,
-    "actions_stats": {
-        "skipped": 0
-    },
-    "update": {
-        "status": "unknown",
-        "has_update": false,
-        "new_version": "20220811-152343/v2.1.8@5afc928c",
-        "old_version": "20220811-152343/v2.1.8@5afc928c",
-        "beta_version": null
-    },
-    "ram_total": 97280,
-    "ram_free": 22488,
-    "fs_size": 65536,
-    "fs_free": 59416,
-    "uptime": 318520,
-    "fw_info": {
-        "device": "shellytrv-60A423DAE8DE",
-        "fw": "20220811-152343/v2.1.8@5afc928c"
-    },
-}
-*/
-
 type ShellyTRVStatus struct {
 	TargetT           ShellyTRVTargetT `json:"target_t"`
 	Tmp               ShellyInfoTmp    `json:"tmp"`
@@ -93,127 +78,297 @@ type ShellyTRVStatus struct {
 	Bat               float32          `json:"bat"`
 }
 
-func NewShellyTRV(deviceId string, mqttOpts *MQTT.ClientOptions) ShellyTRV {
-	client := MQTT.NewClient(mqttOpts)
-	s := ShellyTRV{ShellyDevice{DeviceId: deviceId, mqttClient: client, mqttOpts: mqttOpts}}
-	log.Debug().Str("DeviceName", s.DeviceName()).Msg("New ShellyTRV")
-
-	return s
-}
-
-func (s ShellyTRV) Connect() {
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Error().
-			Str("DeviceName", s.DeviceName()).
-			Err(token.Error()).
-			Msg("Error connecting to MQTT!")
-	}
-	log.Info().Str("DeviceName", s.DeviceName()).Msg("connected")
-}
-
-func (s ShellyTRV) Close() {
-	s.mqttClient.Disconnect(disconnectQiesceTimeMs)
-	log.Info().Str("DeviceName", s.DeviceName()).Msg("disconnected")
-}
-
-func (s ShellyTRV) DeviceName() string {
-	return fmt.Sprintf("shellytrv-%s", s.DeviceId)
-}
-
-func (s ShellyTRV) baseTopic() string {
-	return fmt.Sprintf("shellies/%s", s.DeviceName())
+func NewShellyTRV(
+	deviceId string,
+	mqttOpts *MQTT.ClientOptions,
+	opts ...DeviceOption,
+) ShellyTRV {
+	connectionOptions := newDeviceConfig(opts).connectionOptions
+	return NewConnectionManager(mqttOpts, connectionOptions...).NewShellyTRV(deviceId, opts...)
 }
 
 func (s ShellyTRV) baseCommandTopic() string {
 	return s.baseTopic() + "/thermostat/0/command"
 }
 
-func (s ShellyTRV) SetValve(valvePos float32) {
-	log.Info().
-		Str("DeviceName", s.DeviceName()).
+func (s ShellyTRV) SetValve(valvePos float32) error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SetValveCtx(ctx, valvePos)
+}
+
+func (s ShellyTRV) SetValveCtx(ctx context.Context, valvePos float32) error {
+	if err := checkRange("valvePos", valvePos, 0, 100); err != nil {
+		return err
+	}
+	s.logger.Info().
 		Float32("valvePos", valvePos).
 		Msg("setting valve_pos")
 	topic := s.baseCommandTopic() + "/valve_pos"
-	token := s.mqttClient.Publish(topic, byte(qos), false, fmt.Sprint(valvePos))
-	token.Wait()
+	return s.publish(ctx, topic, fmt.Sprint(valvePos))
 }
 
-func (s ShellyTRV) SetScheduleEnable(enable bool) {
-	log.Info().
-		Str("DeviceName", s.DeviceName()).
+func (s ShellyTRV) SetScheduleEnable(enable bool) error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SetScheduleEnableCtx(ctx, enable)
+}
+
+func (s ShellyTRV) SetScheduleEnableCtx(ctx context.Context, enable bool) error {
+	s.logger.Info().
 		Bool("enable", enable).
 		Msg("setting schedule enable")
 	topic := s.baseCommandTopic() + "/schedule"
-	token := s.mqttClient.Publish(topic, byte(qos), false, fmt.Sprint(Btoi(enable)))
-	token.Wait()
+	return s.publish(ctx, topic, fmt.Sprint(Btoi(enable)))
 }
 
-func (s ShellyTRV) SetTargetTemperature(temperatureDegreeC float32) {
-	log.Info().
-		Str("DeviceName", s.DeviceName()).
+func (s ShellyTRV) SetTargetTemperature(temperatureDegreeC float32) error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SetTargetTemperatureCtx(ctx, temperatureDegreeC)
+}
+
+func (s ShellyTRV) SetTargetTemperatureCtx(ctx context.Context, temperatureDegreeC float32) error {
+	if err := checkRange(
+		"temperatureDegreeC", temperatureDegreeC, minTargetTemperature, maxTargetTemperature,
+	); err != nil {
+		return err
+	}
+	s.logger.Info().
 		Float32("temperatureDegreeC", temperatureDegreeC).
 		Msg("setting target temperature")
 	topic := s.baseCommandTopic() + "/target_t"
-	token := s.mqttClient.Publish(topic, byte(qos), false, fmt.Sprint(temperatureDegreeC))
-	token.Wait()
+	return s.publish(ctx, topic, fmt.Sprint(temperatureDegreeC))
+}
+
+func (s ShellyTRV) SetExternalTemperature(temperatureDegreeC float32) error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SetExternalTemperatureCtx(ctx, temperatureDegreeC)
 }
 
-func (s ShellyTRV) SetExternalTemperature(temperatureDegreeC float32) {
-	log.Info().
-		Str("DeviceName", s.DeviceName()).
+func (s ShellyTRV) SetExternalTemperatureCtx(
+	ctx context.Context,
+	temperatureDegreeC float32,
+) error {
+	if err := checkRange(
+		"temperatureDegreeC", temperatureDegreeC, minExternalTemperature, maxExternalTemperature,
+	); err != nil {
+		return err
+	}
+	s.logger.Info().
 		Float32("temperatureDegreeC", temperatureDegreeC).
 		Msg("setting external temperature")
 	topic := s.baseCommandTopic() + "/ext_t"
-	token := s.mqttClient.Publish(topic, byte(qos), false, fmt.Sprint(temperatureDegreeC))
-	token.Wait()
+	return s.publish(ctx, topic, fmt.Sprint(temperatureDegreeC))
+}
+
+func (s ShellyTRV) pokeSettings() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.pokeSettingsCtx(ctx)
 }
 
-func (s ShellyTRV) pokeSettings() {
-	log.Info().
-		Str("DeviceName", s.DeviceName()).
+func (s ShellyTRV) pokeSettingsCtx(ctx context.Context) error {
+	s.logger.Info().
 		Msg("poking forStr settings")
 	topic := s.baseCommandTopic() + "/settings"
-	token := s.mqttClient.Publish(topic, byte(qos), false, "")
-	token.Wait()
+	return s.publish(ctx, topic, "")
+}
+
+func (s ShellyTRV) SetValveConfirmed(valvePos float32) error {
+	ctx, cancel := confirmContext()
+	defer cancel()
+	return s.SetValveConfirmedCtx(ctx, valvePos)
+}
+
+// SetValveConfirmedCtx sets the valve position and waits until the TRV
+// reports it in its info. The TRV publishes info less often than status, so
+// ctx should allow for a generous wait.
+func (s ShellyTRV) SetValveConfirmedCtx(ctx context.Context, valvePos float32) error {
+	if err := s.TrackStateCtx(ctx); err != nil {
+		return err
+	}
+
+	since := time.Now()
+	if err := s.SetValveCtx(ctx, valvePos); err != nil {
+		return err
+	}
+
+	state, err := s.state.wait(ctx, func(state ShellyTRVState) bool {
+		return state.InfoUpdated.After(since) &&
+			len(state.Info.Thermostats) > 0 &&
+			approxEqual(state.Info.Thermostats[0].Pos, valvePos, valvePosTolerance)
+	})
+	if err != nil {
+		notConfirmed := &NotConfirmedError{
+			DeviceName: s.DeviceName(),
+			Field:      "valve_pos",
+			Want:       valvePos,
+			Err:        waitErr(err),
+		}
+		if state.InfoUpdated.After(since) && len(state.Info.Thermostats) > 0 {
+			notConfirmed.Got = state.Info.Thermostats[0].Pos
+		}
+		return notConfirmed
+	}
+	return nil
+}
+
+func (s ShellyTRV) SetTargetTemperatureConfirmed(temperatureDegreeC float32) error {
+	ctx, cancel := confirmContext()
+	defer cancel()
+	return s.SetTargetTemperatureConfirmedCtx(ctx, temperatureDegreeC)
+}
+
+// SetTargetTemperatureConfirmedCtx sets the target temperature and waits
+// until the TRV reports it in its status.
+func (s ShellyTRV) SetTargetTemperatureConfirmedCtx(
+	ctx context.Context,
+	temperatureDegreeC float32,
+) error {
+	if err := s.TrackStateCtx(ctx); err != nil {
+		return err
+	}
+
+	since := time.Now()
+	if err := s.SetTargetTemperatureCtx(ctx, temperatureDegreeC); err != nil {
+		return err
+	}
+
+	state, err := s.state.wait(ctx, func(state ShellyTRVState) bool {
+		return state.StatusUpdated.After(since) &&
+			approxEqual(state.Status.TargetT.Value, temperatureDegreeC, targetTemperatureTolerance)
+	})
+	if err != nil {
+		notConfirmed := &NotConfirmedError{
+			DeviceName: s.DeviceName(),
+			Field:      "target_t",
+			Want:       temperatureDegreeC,
+			Err:        waitErr(err),
+		}
+		if state.StatusUpdated.After(since) {
+			notConfirmed.Got = state.Status.TargetT.Value
+		}
+		return notConfirmed
+	}
+	return nil
 }
 
 type ShellyTRVStatusCallback = func(status ShellyTRVStatus)
 
-func (s ShellyTRV) SubscribeStatus(statusCallback ShellyTRVStatusCallback) {
+func (s ShellyTRV) SubscribeStatus(statusCallback ShellyTRVStatusCallback) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeStatusCtx(ctx, statusCallback)
+}
+
+func (s ShellyTRV) SubscribeStatusCtx(
+	ctx context.Context,
+	statusCallback ShellyTRVStatusCallback,
+) (*Subscription, error) {
 	topic := s.baseTopic() + "/status"
-	SubscribeJSONHelper(s.mqttClient, topic, statusCallback)
+	callback := func(status ShellyTRVStatus) {
+		s.state.update(func(state *ShellyTRVState) {
+			state.Status = status
+			state.StatusUpdated = time.Now()
+		})
+		if statusCallback != nil {
+			statusCallback(status)
+		}
+	}
+	return s.subscribe(ctx, topic, jsonHandler(s.logger, callback))
 }
 
 type ShellyTRVInfoCallback = func(info ShellyTRVInfo)
 
-func (s ShellyTRV) SubscribeInfo(infoCallback ShellyTRVInfoCallback) {
+func (s ShellyTRV) SubscribeInfo(infoCallback ShellyTRVInfoCallback) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeInfoCtx(ctx, infoCallback)
+}
+
+func (s ShellyTRV) SubscribeInfoCtx(
+	ctx context.Context,
+	infoCallback ShellyTRVInfoCallback,
+) (*Subscription, error) {
 	topic := s.baseTopic() + "/info"
-	SubscribeJSONHelper(s.mqttClient, topic, infoCallback)
+	callback := func(info ShellyTRVInfo) {
+		s.state.update(func(state *ShellyTRVState) {
+			state.Info = info
+			state.InfoUpdated = time.Now()
+		})
+		if infoCallback != nil {
+			infoCallback(info)
+		}
+	}
+	return s.subscribe(ctx, topic, jsonHandler(s.logger, callback))
+}
+
+func (s ShellyTRV) State() ShellyTRVState {
+	return s.state.get()
+}
+
+// LastStatus returns the last received status and when it was received.
+func (s ShellyTRV) LastStatus() (ShellyTRVStatus, time.Time) {
+	state := s.state.get()
+	return state.Status, state.StatusUpdated
+}
+
+// LastInfo returns the last received info and when it was received.
+func (s ShellyTRV) LastInfo() (ShellyTRVInfo, time.Time) {
+	state := s.state.get()
+	return state.Info, state.InfoUpdated
+}
+
+func (s ShellyTRV) TrackState() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.TrackStateCtx(ctx)
 }
 
-func (s ShellyTRV) SubscribeAll() {
+// TrackStateCtx subscribes to the topics backing State without registering
+// any callbacks. Calling it again is a no-op.
+func (s ShellyTRV) TrackStateCtx(ctx context.Context) error {
+	return s.state.track(func() error {
+		_, err := subscribeAll(ctx, []func() (*Subscription, error){
+			func() (*Subscription, error) { return s.SubscribeStatusCtx(ctx, nil) },
+			func() (*Subscription, error) { return s.SubscribeInfoCtx(ctx, nil) },
+		})
+		return err
+	})
+}
+
+func (s ShellyTRV) SubscribeAll() (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeAllCtx(ctx)
+}
+
+func (s ShellyTRV) SubscribeAllCtx(ctx context.Context) (*Subscription, error) {
 	topic := s.baseTopic() + "/#"
 
 	callback := func(client MQTT.Client, message MQTT.Message) {
-		log.Debug().
-			Str("DeviceName", s.DeviceName()).
-			Str("message.Topic", string(message.Topic())).
-			Str("message.Payload", string(message.Payload())).
-			Msg("received message")
+		logMessage(s.logger, message)
 	}
 
-	if token := s.mqttClient.Subscribe(topic, byte(qos), callback); token.Wait() &&
-		token.Error() != nil {
-		log.Error().
-			Str("DeviceName", s.DeviceName()).
-			Str("topic", topic).
-			Err(token.Error()).
-			Msg("Error subscribing!")
-		return
-	}
+	return s.subscribe(ctx, topic, callback)
+}
+
+// StatusEvents streams status messages until ctx is done, then closes the
+// channel.
+func (s ShellyTRV) StatusEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan ShellyTRVStatus, error) {
+	return openStream(ctx, s.logger, opts, s.SubscribeStatusCtx)
+}
 
-	log.Info().
-		Str("DeviceName", s.DeviceName()).
-		Str("topic", topic).
-		Msg("Subscribed!")
+// InfoEvents streams info messages until ctx is done, then closes the
+// channel.
+func (s ShellyTRV) InfoEvents(
+	ctx context.Context,
+	opts ...StreamOption,
+) (<-chan ShellyTRVInfo, error) {
+	return openStream(ctx, s.logger, opts, s.SubscribeInfoCtx)
 }
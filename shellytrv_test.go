@@ -2,8 +2,11 @@ package shelly
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
+
+	"github.com/washed/shelly-go/shellytest"
 )
 
 const ShellyTRVInfoJSON = `
@@ -45,3 +48,89 @@ func TestShellyTRVDatumFromJSON(t *testing.T) {
 	}
 	fmt.Printf("sd: %+v", sd)
 }
+
+const shellyTRVStatusJSON = `{
+    "target_t": {"enabled": true, "value": 21.5, "units": "C"},
+    "tmp": {"value": 19.2, "units": "C", "is_valid": true},
+    "temperature_offset": 0,
+    "bat": 87
+}`
+
+func TestShellyTRVCommands(t *testing.T) {
+	const commandTopic = "shellies/shellytrv-60A423DAE8DE/thermostat/0/command"
+	tests := []struct {
+		name    string
+		command func(s ShellyTRV) error
+		topic   string
+		payload string
+		err     error
+	}{
+		{
+			name:    "valve",
+			command: func(s ShellyTRV) error { return s.SetValve(50) },
+			topic:   commandTopic + "/valve_pos",
+			payload: "50",
+		},
+		{
+			name:    "schedule",
+			command: func(s ShellyTRV) error { return s.SetScheduleEnable(true) },
+			topic:   commandTopic + "/schedule",
+			payload: "1",
+		},
+		{
+			name:    "target temperature",
+			command: func(s ShellyTRV) error { return s.SetTargetTemperature(21.5) },
+			topic:   commandTopic + "/target_t",
+			payload: "21.5",
+		},
+		{
+			name:    "external temperature",
+			command: func(s ShellyTRV) error { return s.SetExternalTemperature(-3.5) },
+			topic:   commandTopic + "/ext_t",
+			payload: "-3.5",
+		},
+		{
+			name:    "valve out of range",
+			command: func(s ShellyTRV) error { return s.SetValve(101) },
+			err:     ErrInvalidArgument,
+		},
+		{
+			name:    "target temperature out of range",
+			command: func(s ShellyTRV) error { return s.SetTargetTemperature(35) },
+			err:     ErrInvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, broker := newTestConnection(t)
+			trv := conn.NewShellyTRV("60A423DAE8DE")
+
+			err := test.command(trv)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				if published := broker.Published(); len(published) != 0 {
+					t.Errorf("published %v for an invalid command", published)
+				}
+				return
+			}
+			checkPublished(t, broker, shellytest.Publication{
+				Topic:   test.topic,
+				Payload: []byte(test.payload),
+			})
+		})
+	}
+}
+
+func TestShellyTRVSetTargetTemperatureConfirmed(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	trv := conn.NewShellyTRV("60A423DAE8DE")
+	broker.OnPublish("shellies/+/thermostat/0/command/target_t", func(shellytest.Publication) {
+		broker.Publish("shellies/shellytrv-60A423DAE8DE/status", shellyTRVStatusJSON)
+	})
+
+	if err := trv.SetTargetTemperatureConfirmedCtx(testContext(t), 21.5); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build go1.21
+
+package shelly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// WithSlogHandler sets the logger of a ConnectionManager to one writing to
+// handler. It is a shorthand for WithLogger(NewSlogLogger(handler)).
+func WithSlogHandler(handler slog.Handler) ConnectionOption {
+	return WithLogger(NewSlogLogger(handler))
+}
+
+// NewSlogLogger returns a zerolog.Logger that passes every event on to
+// handler, converting levels and fields. The logger's level is the lowest
+// one handler is enabled for when NewSlogLogger is called, so that events
+// handler would drop are not even built.
+func NewSlogLogger(handler slog.Handler) zerolog.Logger {
+	return zerolog.New(slogWriter{handler: handler}).Level(lowestEnabledLevel(handler))
+}
+
+func lowestEnabledLevel(handler slog.Handler) zerolog.Level {
+	levels := []zerolog.Level{
+		zerolog.TraceLevel, zerolog.DebugLevel, zerolog.InfoLevel,
+		zerolog.WarnLevel, zerolog.ErrorLevel,
+	}
+	for _, level := range levels {
+		if handler.Enabled(context.Background(), slogLevel(level)) {
+			return level
+		}
+	}
+	return zerolog.Disabled
+}
+
+// slogWriter turns the JSON events written by zerolog into slog records.
+type slogWriter struct {
+	handler slog.Handler
+}
+
+func (w slogWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w slogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	ctx := context.Background()
+	slogLevel := slogLevel(level)
+	if !w.handler.Enabled(ctx, slogLevel) {
+		return len(p), nil
+	}
+
+	record := slog.NewRecord(time.Now(), slogLevel, "", 0)
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	if _, err := decoder.Token(); err != nil {
+		return 0, err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, err
+		}
+		key, _ := token.(string)
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return 0, err
+		}
+
+		switch key {
+		case zerolog.MessageFieldName:
+			record.Message, _ = value.(string)
+		case zerolog.LevelFieldName:
+		default:
+			record.AddAttrs(slog.Any(key, value))
+		}
+	}
+
+	if err := w.handler.Handle(ctx, record); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func slogLevel(level zerolog.Level) slog.Level {
+	switch level {
+	case zerolog.TraceLevel:
+		return slog.LevelDebug - 4
+	case zerolog.DebugLevel:
+		return slog.LevelDebug
+	case zerolog.WarnLevel:
+		return slog.LevelWarn
+	case zerolog.ErrorLevel, zerolog.FatalLevel, zerolog.PanicLevel:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,53 @@
+//go:build go1.21
+
+package shelly
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewSlogLogger(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	logger.Debug().Msg("hidden")
+	logger.Warn().Str("topic", "shellies/x/online").Int("n", 3).Msg("dropping message")
+
+	got := out.String()
+	if strings.Contains(got, "hidden") {
+		t.Errorf("debug event should be filtered by the handler: %s", got)
+	}
+	wants := []string{"level=WARN", `msg="dropping message"`, "topic=shellies/x/online", "n=3"}
+	for _, want := range wants {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestSlogLoggerLevel(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		want  zerolog.Level
+	}{
+		{slog.LevelDebug - 4, zerolog.TraceLevel},
+		{slog.LevelDebug, zerolog.DebugLevel},
+		{slog.LevelInfo, zerolog.InfoLevel},
+		{slog.LevelWarn, zerolog.WarnLevel},
+		{slog.LevelError, zerolog.ErrorLevel},
+		{slog.LevelError + 4, zerolog.Disabled},
+	}
+	for _, test := range tests {
+		handler := slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: test.level})
+		logger := NewSlogLogger(handler)
+		if got := logger.GetLevel(); got != test.want {
+			t.Errorf("handler at %v: got level %v, want %v", test.level, got, test.want)
+		}
+	}
+}
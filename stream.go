@@ -0,0 +1,167 @@
+package shelly
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// OverflowPolicy decides what a stream does with a value when its buffer is
+// full.
+type OverflowPolicy int
+
+const (
+	// DropNewest discards the value that did not fit.
+	DropNewest OverflowPolicy = iota
+	// DropOldest discards the oldest buffered value to make room.
+	DropOldest
+	// Block waits for the reader, stalling delivery of the device's further
+	// messages until the value is taken or the stream's context is done.
+	Block
+)
+
+type streamConfig struct {
+	buffer int
+	policy OverflowPolicy
+}
+
+type StreamOption func(*streamConfig)
+
+// WithBuffer sets the channel capacity of a stream.
+func WithBuffer(size int) StreamOption {
+	return func(c *streamConfig) {
+		c.buffer = size
+	}
+}
+
+// WithOverflowPolicy sets what happens when a stream's buffer is full.
+func WithOverflowPolicy(policy OverflowPolicy) StreamOption {
+	return func(c *streamConfig) {
+		c.policy = policy
+	}
+}
+
+// Readings delivered on scalar topics carry the time they were received.
+type (
+	PowerReading struct {
+		Power float32
+		Time  time.Time
+	}
+	RelayReading struct {
+		On   bool
+		Time time.Time
+	}
+	BatteryReading struct {
+		Battery float32
+		Time    time.Time
+	}
+	OpenStateReading struct {
+		Open bool
+		Time time.Time
+	}
+	OnlineReading struct {
+		Online bool
+		Time   time.Time
+	}
+)
+
+// stream feeds a channel from subscription callbacks and closes it when its
+// context is done.
+type stream[T any] struct {
+	ctx    context.Context
+	ch     chan T
+	policy OverflowPolicy
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newStream[T any](ctx context.Context, opts []StreamOption) *stream[T] {
+	config := streamConfig{buffer: defaultStreamBuffer, policy: DropNewest}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	s := &stream[T]{ctx: ctx, ch: make(chan T, config.buffer), policy: config.policy}
+	go func() {
+		<-ctx.Done()
+		s.close()
+	}()
+	return s
+}
+
+func (s *stream[T]) send(value T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	switch s.policy {
+	case Block:
+		select {
+		case s.ch <- value:
+		case <-s.ctx.Done():
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- value:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- value:
+		default:
+		}
+	}
+}
+
+func (s *stream[T]) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+// openStream creates a stream and feeds it through subscribe, which is given
+// a context bounded by tokenTimeout for the broker acknowledgement. The
+// subscription is dropped when ctx is done.
+func openStream[T any](
+	ctx context.Context,
+	logger *zerolog.Logger,
+	opts []StreamOption,
+	subscribe func(ctx context.Context, send func(T)) (*Subscription, error),
+) (<-chan T, error) {
+	s := newStream[T](ctx, opts)
+
+	subscribeCtx, cancel := context.WithTimeout(ctx, tokenTimeout)
+	defer cancel()
+	subscription, err := subscribe(subscribeCtx, s.send)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		unsubscribeCtx, cancel := defaultContext()
+		defer cancel()
+		if err := subscription.UnsubscribeCtx(unsubscribeCtx); err != nil {
+			logger.Error().Err(err).Msg("Error closing stream!")
+		}
+	}()
+	return s.ch, nil
+}
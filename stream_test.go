@@ -0,0 +1,33 @@
+package shelly
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStreamOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy OverflowPolicy
+		want   []int
+	}{
+		{DropNewest, []int{1, 2}},
+		{DropOldest, []int{3, 4}},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		s := newStream[int](ctx, []StreamOption{WithBuffer(2), WithOverflowPolicy(tt.policy)})
+		for i := 1; i <= 4; i++ {
+			s.send(i)
+		}
+		cancel()
+
+		var got []int
+		for value := range s.ch {
+			got = append(got, value)
+		}
+		if len(got) != len(tt.want) || got[0] != tt.want[0] || got[1] != tt.want[1] {
+			t.Errorf("policy %d: got %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package shelly
+
+import (
+	"context"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+)
+
+// Subscription is returned by every Subscribe method. Unsubscribe stops
+// delivery to the callback and drops the broker subscription once no other
+// listener needs the topic.
+type Subscription struct {
+	unsubscribe func(ctx context.Context) error
+
+	once sync.Once
+	err  error
+}
+
+func newSubscription(unsubscribe func(ctx context.Context) error) *Subscription {
+	return &Subscription{unsubscribe: unsubscribe}
+}
+
+func (s *Subscription) Unsubscribe() error {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.UnsubscribeCtx(ctx)
+}
+
+// UnsubscribeCtx is like Unsubscribe, but ctx bounds the wait for the broker.
+// Only the first call has any effect; later calls return its result.
+func (s *Subscription) UnsubscribeCtx(ctx context.Context) error {
+	s.once.Do(func() {
+		s.err = s.unsubscribe(ctx)
+	})
+	return s.err
+}
+
+type listener struct {
+	handler MQTT.MessageHandler
+}
+
+// subscriptionSet fans messages out to every listener of a topic filter, so
+// several callbacks can share one broker subscription. Each filter with
+// listeners is registered as a route with the ConnectionManager, which owns
+// the broker subscriptions and replays them after a reconnect.
+type subscriptionSet struct {
+	conn       *ConnectionManager
+	dispatcher *dispatcher
+	// topicPrefix selects the wildcard subscription of the filters.
+	topicPrefix string
+	qos         byte
+
+	// subscribeMu serializes subscribe and remove, which wait for the
+	// broker. mu only guards routes and is held briefly, as messages are
+	// delivered under it.
+	subscribeMu sync.Mutex
+	mu          sync.Mutex
+	routes      map[string]*routeEntry
+}
+
+func newSubscriptionSet(
+	conn *ConnectionManager,
+	dispatcher *dispatcher,
+	topicPrefix string,
+	qos byte,
+) *subscriptionSet {
+	return &subscriptionSet{
+		conn:        conn,
+		dispatcher:  dispatcher,
+		topicPrefix: topicPrefix,
+		qos:         qos,
+		routes:      map[string]*routeEntry{},
+	}
+}
+
+// subscribe adds handler as a listener of filter, subscribing at the broker
+// if filter has no listeners yet.
+func (s *subscriptionSet) subscribe(
+	ctx context.Context,
+	filter string,
+	handler MQTT.MessageHandler,
+) (*Subscription, error) {
+	s.subscribeMu.Lock()
+	defer s.subscribeMu.Unlock()
+
+	l := &listener{handler: handler}
+	unsubscribe := func(ctx context.Context) error {
+		return s.remove(ctx, filter, l)
+	}
+
+	s.mu.Lock()
+	entry, ok := s.routes[filter]
+	if ok {
+		// Listener slices are replaced rather than modified, so deliver can
+		// hand them to the dispatcher without copying.
+		entry.listeners = append(entry.listeners[:len(entry.listeners):len(entry.listeners)], l)
+	}
+	s.mu.Unlock()
+	if ok {
+		return newSubscription(unsubscribe), nil
+	}
+
+	// Route before subscribing, as the broker sends retained messages
+	// right after acknowledging the subscription.
+	entry = &routeEntry{filter: filter, set: s, listeners: []*listener{l}}
+	s.mu.Lock()
+	s.routes[filter] = entry
+	s.mu.Unlock()
+	s.conn.router.add(entry)
+
+	if err := s.conn.acquire(ctx, filter, s.topicPrefix, s.qos); err != nil {
+		s.conn.router.remove(entry)
+		s.mu.Lock()
+		delete(s.routes, filter)
+		s.mu.Unlock()
+		return nil, err
+	}
+	return newSubscription(unsubscribe), nil
+}
+
+// remove drops a listener and unsubscribes at the broker if it was the last
+// one of its filter.
+func (s *subscriptionSet) remove(ctx context.Context, filter string, l *listener) error {
+	s.subscribeMu.Lock()
+	defer s.subscribeMu.Unlock()
+
+	s.mu.Lock()
+	entry, ok := s.routes[filter]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	entry.listeners = removeListener(entry.listeners, l)
+	last := len(entry.listeners) == 0
+	if last {
+		delete(s.routes, filter)
+	}
+	s.mu.Unlock()
+
+	if !last {
+		return nil
+	}
+	s.conn.router.remove(entry)
+	return s.conn.release(ctx, filter, s.topicPrefix)
+}
+
+// deliver hands a message matching entry's filter to the dispatcher, which
+// calls every listener in the order they subscribed.
+func (s *subscriptionSet) deliver(entry *routeEntry, client MQTT.Client, message MQTT.Message) {
+	s.mu.Lock()
+	listeners := entry.listeners
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return
+	}
+
+	s.dispatcher.enqueue(dispatchJob{
+		listeners: listeners,
+		client:    client,
+		message:   message,
+	})
+}
+
+func removeListener(listeners []*listener, l *listener) []*listener {
+	for i := range listeners {
+		if listeners[i] == l {
+			return append(listeners[:i:i], listeners[i+1:]...)
+		}
+	}
+	return listeners
+}
+
+// subscribeAll calls every subscriber in order. If one fails, the
+// subscriptions made so far are ended again before its error is returned.
+func subscribeAll(
+	ctx context.Context,
+	subscribers []func() (*Subscription, error),
+) ([]*Subscription, error) {
+	subscriptions := make([]*Subscription, 0, len(subscribers))
+	for _, subscribe := range subscribers {
+		subscription, err := subscribe()
+		if err != nil {
+			unsubscribeAll(ctx, subscriptions)
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+// unsubscribeAll ends every subscription and returns the first error.
+func unsubscribeAll(ctx context.Context, subscriptions []*Subscription) error {
+	var first error
+	for _, subscription := range subscriptions {
+		if err := subscription.UnsubscribeCtx(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func checkedUnsubscribe(
+	ctx context.Context,
+	logger *zerolog.Logger,
+	mqttClient MQTT.Client,
+	topic string,
+) error {
+	if !mqttClient.IsConnected() {
+		// The broker forgets the subscription with the session anyway.
+		return nil
+	}
+
+	if err := waitToken(ctx, mqttClient.Unsubscribe(topic)); err != nil {
+		logger.Error().
+			Str("topic", topic).
+			Err(err).
+			Msg("Error unsubscribing!")
+		return err
+	}
+
+	logger.Info().
+		Str("topic", topic).
+		Msg("Unsubscribed!")
+
+	return nil
+}
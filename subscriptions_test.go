@@ -0,0 +1,112 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/washed/shelly-go/shellytest"
+)
+
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m testMessage) Duplicate() bool   { return false }
+func (m testMessage) Qos() byte         { return 0 }
+func (m testMessage) Retained() bool    { return false }
+func (m testMessage) Topic() string     { return m.topic }
+func (m testMessage) MessageID() uint16 { return 0 }
+func (m testMessage) Payload() []byte   { return m.payload }
+func (m testMessage) Ack()              {}
+
+func TestSubscriptionSetRemove(t *testing.T) {
+	const topic = "shellies/x/relay/0"
+	conn := NewConnectionManager(MQTT.NewClientOptions())
+	set := newSubscriptionSet(conn, newDispatcher(&nopLogger, 8, nil), "", defaultQoS)
+
+	calls := make(chan string, 8)
+	first := &listener{handler: func(MQTT.Client, MQTT.Message) { calls <- "first" }}
+	second := &listener{handler: func(MQTT.Client, MQTT.Message) { calls <- "second" }}
+	entry := &routeEntry{filter: topic, set: set, listeners: []*listener{first, second}}
+	set.routes[topic] = entry
+	conn.router.add(entry)
+
+	conn.route(conn.Client(), testMessage{topic: topic}, "")
+	if got := []string{<-calls, <-calls}; got[0] != "first" || got[1] != "second" {
+		t.Errorf("got calls %v, want [first second]", got)
+	}
+
+	if err := set.remove(context.Background(), topic, first); err != nil {
+		t.Fatal(err)
+	}
+	conn.route(conn.Client(), testMessage{topic: topic}, "")
+	if got := <-calls; got != "second" {
+		t.Errorf("got call %s, want second", got)
+	}
+
+	if err := set.remove(context.Background(), topic, second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := set.routes[topic]; ok {
+		t.Error("topic without listeners should be forgotten")
+	}
+	if entries := conn.router.match(topic, nil); len(entries) != 0 {
+		t.Errorf("got %d routes after removing every listener, want 0", len(entries))
+	}
+}
+
+func TestSubscribeAllFailure(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	set := newSubscriptionSet(conn, newDispatcher(&nopLogger, 8, nil), "", defaultQoS)
+	ctx := testContext(t)
+	handler := func(MQTT.Client, MQTT.Message) {}
+
+	failed := errors.New("failed")
+	_, err := subscribeAll(ctx, []func() (*Subscription, error){
+		func() (*Subscription, error) { return set.subscribe(ctx, "shellies/x/a", handler) },
+		func() (*Subscription, error) { return set.subscribe(ctx, "shellies/x/b", handler) },
+		func() (*Subscription, error) { return nil, failed },
+	})
+	if err != failed {
+		t.Fatalf("got error %v, want %v", err, failed)
+	}
+	for _, filter := range []string{"shellies/x/a", "shellies/x/b"} {
+		if broker.Subscribed(filter) {
+			t.Errorf("%s still subscribed after a failed subscribeAll", filter)
+		}
+	}
+	if len(set.routes) != 0 {
+		t.Errorf("got %d routes after a failed subscribeAll, want 0", len(set.routes))
+	}
+}
+
+func TestSubscribeRetained(t *testing.T) {
+	// Without the resubscribe after connecting, which would deliver the
+	// retained message again, only the first subscription can deliver it.
+	broker := shellytest.NewBroker()
+	newClient := func(opts *MQTT.ClientOptions) MQTT.Client {
+		opts.SetOnConnectHandler(nil)
+		return broker.NewClient(opts)
+	}
+	conn := NewConnectionManager(MQTT.NewClientOptions(), WithClientFactory(newClient))
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+
+	// The broker sends retained messages as soon as it acknowledges the
+	// subscription.
+	broker.PublishRetained("shellies/shellyplug-s-EF6948/online", "true")
+
+	topics := make(chan string, 1)
+	handler := func(_ MQTT.Client, message MQTT.Message) { topics <- message.Topic() }
+	if _, err := conn.Subscribe("shellies/+/online", handler); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, topics); got != "shellies/shellyplug-s-EF6948/online" {
+		t.Errorf("got topic %s", got)
+	}
+}
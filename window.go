@@ -0,0 +1,332 @@
+package shelly
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WindowPosition is the position of a tilt-and-turn window carrying a DW2.
+type WindowPosition int
+
+const (
+	// WindowUnknown means nothing was received yet, or the window is open
+	// but the sensor reports no tilt because it is not calibrated.
+	WindowUnknown WindowPosition = iota
+	WindowClosed
+	WindowTilted
+	WindowOpen
+)
+
+func (p WindowPosition) String() string {
+	switch p {
+	case WindowUnknown:
+		return "unknown"
+	case WindowClosed:
+		return "closed"
+	case WindowTilted:
+		return "tilted"
+	case WindowOpen:
+		return "open"
+	default:
+		return fmt.Sprintf("WindowPosition(%d)", int(p))
+	}
+}
+
+// WindowCalibration tells tilted from fully open windows by the tilt the
+// DW2 reports in each position. A window turned open reports about the same
+// tilt as a closed one, 0 degrees, while a tilted one reports a few degrees
+// more.
+type WindowCalibration struct {
+	// TiltedAngle is the tilt in degrees while the window is tilted.
+	TiltedAngle int
+	// OpenAngle is the tilt in degrees while the window is fully open.
+	OpenAngle int
+	// Hysteresis is how many degrees the tilt has to pass the midpoint of
+	// the two angles by before a tilted window counts as open or the other
+	// way round, so that a wobbling sash does not flip the position.
+	Hysteresis int
+}
+
+// DefaultWindowCalibration suits windows that tilt by about 12 degrees.
+var DefaultWindowCalibration = WindowCalibration{TiltedAngle: 12, OpenAngle: 0, Hysteresis: 2}
+
+// WindowClassifier combines the open state and the tilt of a DW2 into a
+// WindowPosition. It is safe for concurrent use.
+type WindowClassifier struct {
+	calibration WindowCalibration
+
+	mu       sync.Mutex
+	open     bool
+	tilt     int
+	known    bool
+	position WindowPosition
+}
+
+// NewWindowClassifier returns a classifier for a window calibrated with c.
+// If both angles of c are equal, open windows always count as open.
+func NewWindowClassifier(c WindowCalibration) *WindowClassifier {
+	if c.Hysteresis < 0 {
+		c.Hysteresis = 0
+	}
+	return &WindowClassifier{calibration: c}
+}
+
+// Position returns the current position.
+func (w *WindowClassifier) Position() WindowPosition {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.position
+}
+
+// Update classifies a reading of both the open state and the tilt.
+func (w *WindowClassifier) Update(open bool, tilt int) WindowPosition {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.open, w.tilt, w.known = open, tilt, true
+	return w.classify()
+}
+
+// UpdateOpen classifies a new open state with the last known tilt.
+func (w *WindowClassifier) UpdateOpen(open bool) WindowPosition {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.open, w.known = open, true
+	return w.classify()
+}
+
+// UpdateTilt classifies a new tilt with the last known open state. The
+// position stays unknown until the open state is known.
+func (w *WindowClassifier) UpdateTilt(tilt int) WindowPosition {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.tilt = tilt
+	if !w.known {
+		return w.position
+	}
+	return w.classify()
+}
+
+func (w *WindowClassifier) classify() WindowPosition {
+	c := w.calibration
+	switch {
+	case !w.open:
+		w.position = WindowClosed
+	case w.tilt < 0:
+		w.position = WindowUnknown
+	case c.TiltedAngle == c.OpenAngle:
+		w.position = WindowOpen
+	default:
+		// distance is positive on the tilted side of the midpoint.
+		distance := float64(w.tilt) - float64(c.TiltedAngle+c.OpenAngle)/2
+		if c.TiltedAngle < c.OpenAngle {
+			distance = -distance
+		}
+		// Only moving between tilted and open needs hysteresis, a window
+		// that was closed goes straight to the nearer position.
+		h := float64(c.Hysteresis)
+		var tilted bool
+		switch w.position {
+		case WindowTilted:
+			tilted = distance > -h
+		case WindowOpen:
+			tilted = distance >= h
+		default:
+			tilted = distance > 0
+		}
+		if tilted {
+			w.position = WindowTilted
+		} else {
+			w.position = WindowOpen
+		}
+	}
+	return w.position
+}
+
+// windowSettleTime is how long a window that reported being open waits for
+// the tilt that follows, since the DW2 publishes sensor/state before
+// sensor/tilt.
+const windowSettleTime = 500 * time.Millisecond
+
+// windowTracker feeds the readings of one subscription to its own
+// classifier, so that the hysteresis applies once per reading. An open
+// state is only classified together with the tilt following it, or once
+// windowSettleTime passed without one, so moving from closed to tilted does
+// not briefly report the window open. The settle timer hands its result to
+// schedule, which runs it in order with the readings.
+type windowTracker struct {
+	classifier *WindowClassifier
+	report     func(position WindowPosition)
+	schedule   func(settle func())
+
+	mu      sync.Mutex
+	pending *time.Timer
+	// generation tells a settle that was cancelled after its timer fired
+	// from the current one.
+	generation uint64
+	stopped    bool
+}
+
+func newWindowTracker(
+	calibration WindowCalibration,
+	report func(position WindowPosition),
+	schedule func(settle func()),
+) *windowTracker {
+	return &windowTracker{
+		classifier: NewWindowClassifier(calibration),
+		report:     report,
+		schedule:   schedule,
+	}
+}
+
+func (w *windowTracker) updateOpen(open bool) {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.cancelPending()
+	if !open {
+		position := w.classifier.UpdateOpen(false)
+		w.mu.Unlock()
+		w.report(position)
+		return
+	}
+	generation := w.generation
+	w.pending = time.AfterFunc(windowSettleTime, func() {
+		w.schedule(func() { w.settle(generation) })
+	})
+	w.mu.Unlock()
+}
+
+// settle classifies an open state no tilt followed.
+func (w *windowTracker) settle(generation uint64) {
+	w.mu.Lock()
+	if w.stopped || w.pending == nil || w.generation != generation {
+		w.mu.Unlock()
+		return
+	}
+	w.pending = nil
+	w.generation++
+	position := w.classifier.UpdateOpen(true)
+	w.mu.Unlock()
+	w.report(position)
+}
+
+func (w *windowTracker) updateTilt(tilt int) {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	var position WindowPosition
+	if w.cancelPending() {
+		position = w.classifier.Update(true, tilt)
+	} else {
+		position = w.classifier.UpdateTilt(tilt)
+	}
+	w.mu.Unlock()
+	w.report(position)
+}
+
+func (w *windowTracker) update(open bool, tilt int) {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.cancelPending()
+	position := w.classifier.Update(open, tilt)
+	w.mu.Unlock()
+	w.report(position)
+}
+
+func (w *windowTracker) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cancelPending()
+	w.stopped = true
+}
+
+// cancelPending drops an open state waiting for its tilt and reports
+// whether there was one. w.mu must be held.
+func (w *windowTracker) cancelPending() bool {
+	if w.pending == nil {
+		return false
+	}
+	w.pending.Stop()
+	w.pending = nil
+	w.generation++
+	return true
+}
+
+type WindowPositionCallback = func(position WindowPosition)
+
+func (s ShellyDW2) SubscribeWindowPosition(
+	positionCallback WindowPositionCallback,
+) (*Subscription, error) {
+	ctx, cancel := defaultContext()
+	defer cancel()
+	return s.SubscribeWindowPositionCtx(ctx, positionCallback)
+}
+
+// SubscribeWindowPositionCtx classifies the open state and tilt readings of
+// the DW2, see WithWindowCalibration, and calls positionCallback whenever
+// the position changes.
+func (s ShellyDW2) SubscribeWindowPositionCtx(
+	ctx context.Context,
+	positionCallback WindowPositionCallback,
+) (*Subscription, error) {
+	// Readings and settled open states are all delivered by the device's
+	// dispatcher, one at a time.
+	last := WindowUnknown
+	report := func(position WindowPosition) {
+		s.state.update(func(state *ShellyDW2State) {
+			state.Window = position
+			state.WindowUpdated = time.Now()
+		})
+
+		changed := position != last
+		last = position
+		if changed && positionCallback != nil {
+			positionCallback(position)
+		}
+	}
+	schedule := func(settle func()) {
+		s.dispatcher.enqueueFunc(s.baseTopic()+"/sensor/state", settle)
+	}
+	tracker := newWindowTracker(s.config.windowCalibration, report, schedule)
+
+	subscriptions, err := subscribeAll(ctx, []func() (*Subscription, error){
+		func() (*Subscription, error) {
+			return s.SubscribeOpenStateCtx(ctx,
+				func() { tracker.updateOpen(true) },
+				func() { tracker.updateOpen(false) },
+			)
+		},
+		func() (*Subscription, error) {
+			return s.SubscribeTiltCtx(ctx, tracker.updateTilt)
+		},
+		func() (*Subscription, error) {
+			return s.SubscribeInfoCtx(ctx, func(info ShellyDW2Info) {
+				if info.Sensor.State != "" {
+					tracker.update(info.Sensor.IsOpen(), info.Accel.Tilt)
+				}
+			})
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newSubscription(func(ctx context.Context) error {
+		tracker.stop()
+		return unsubscribeAll(ctx, subscriptions)
+	}), nil
+}
+
+// WindowPosition returns the current position of the window. It is only
+// kept up to date while the state is tracked or the position subscribed to.
+func (s ShellyDW2) WindowPosition() WindowPosition {
+	return s.state.get().Window
+}
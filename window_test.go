@@ -0,0 +1,95 @@
+package shelly
+
+import "testing"
+
+func TestWindowClassifier(t *testing.T) {
+	type reading struct {
+		open bool
+		tilt int
+		want WindowPosition
+	}
+	tests := []struct {
+		name        string
+		calibration WindowCalibration
+		readings    []reading
+	}{
+		{
+			"default", DefaultWindowCalibration,
+			[]reading{
+				{false, 0, WindowClosed},
+				{true, 12, WindowTilted},
+				{true, 0, WindowOpen},
+				{false, 0, WindowClosed},
+			},
+		},
+		{
+			"hysteresis", WindowCalibration{TiltedAngle: 10, OpenAngle: 0, Hysteresis: 2},
+			[]reading{
+				{true, 10, WindowTilted},
+				// The midpoint is 5, tilted windows stay tilted down to 4.
+				{true, 4, WindowTilted},
+				{true, 3, WindowOpen},
+				// Open windows stay open up to 6.
+				{true, 6, WindowOpen},
+				{true, 7, WindowTilted},
+			},
+		},
+		{
+			"from closed", WindowCalibration{TiltedAngle: 10, OpenAngle: 0, Hysteresis: 4},
+			[]reading{
+				{false, 0, WindowClosed},
+				{true, 6, WindowTilted},
+				{false, 0, WindowClosed},
+				{true, 4, WindowOpen},
+			},
+		},
+		{
+			"tilted below open", WindowCalibration{TiltedAngle: 80, OpenAngle: 90, Hysteresis: 1},
+			[]reading{
+				{true, 90, WindowOpen},
+				{true, 86, WindowOpen},
+				{true, 83, WindowTilted},
+			},
+		},
+		{
+			"not calibrated", DefaultWindowCalibration,
+			[]reading{
+				{true, -1, WindowUnknown},
+				{false, -1, WindowClosed},
+			},
+		},
+		{
+			"equal angles", WindowCalibration{TiltedAngle: 5, OpenAngle: 5},
+			[]reading{
+				{true, 5, WindowOpen},
+				{true, 30, WindowOpen},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := NewWindowClassifier(test.calibration)
+			for i, r := range test.readings {
+				if got := w.Update(r.open, r.tilt); got != r.want {
+					t.Errorf("reading %d %+v: got %v, want %v", i, r, got, r.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWindowClassifierPartialUpdates(t *testing.T) {
+	w := NewWindowClassifier(DefaultWindowCalibration)
+	if got := w.UpdateTilt(12); got != WindowUnknown {
+		t.Errorf("got %v before the open state is known, want unknown", got)
+	}
+	if got := w.UpdateOpen(true); got != WindowTilted {
+		t.Errorf("got %v, want tilted", got)
+	}
+	if got := w.UpdateTilt(0); got != WindowOpen {
+		t.Errorf("got %v, want open", got)
+	}
+	if got := w.Position(); got != WindowOpen {
+		t.Errorf("got position %v, want open", got)
+	}
+}